@@ -0,0 +1,158 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrForbidden is wrapped by the error returned when the manager's authorizer refuses a request.
+var ErrForbidden = errors.New("forbidden")
+
+////////////////
+// AUTHORIZER //
+////////////////
+
+// Authorizer decides whether a request is allowed to reach its route. It is consulted by the
+// 	processing loop before the attached function (and its middleware) runs. Permissions are
+// 	the ones the route was attached with (see Permissions), or just the route itself if it
+// 	wasn't given any. Returning an error refuses the request. The error is wrapped with
+// 	ErrForbidden if it doesn't already wrap it.
+type Authorizer interface {
+	Authorize(managerName string, request *Request, permissions []string) error
+}
+
+// SetAuthorizer sets the authorizer the manager checks requests with. With no authorizer
+// 	(the default, or after setting nil) every request is allowed.
+func (manager *Manager) SetAuthorizer(authorizer Authorizer) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.authorizer = authorizer
+}
+
+// Permissions annotates a route with the permissions needed to call it. A caller needs any
+// 	one of them.
+func Permissions(permissions ...string) RouteOption {
+	return func(options *routeOptions) {
+		options.permissions = append(options.permissions, permissions...)
+	}
+}
+
+// Public annotates a route which anyone can call. The authorizer isn't consulted at all.
+func Public() RouteOption {
+	return func(options *routeOptions) {
+		options.public = true
+	}
+}
+
+/////////////////
+// ROLE POLICY //
+/////////////////
+
+/*
+RolePolicy is a built in Authorizer which maps callers to roles and roles to permissions. The
+caller is read from the request's MetadataCaller, so requests without a caller are refused.
+
+Permissions granted to a role can end in "*" to match every permission starting with what comes
+before it, so "orders.*" covers "orders.create" and "orders.cancel", and "*" covers everything.
+
+	policy := managers.NewRolePolicy().
+		Grant("admin", "*").
+		Grant("clerk", "orders.*", "inventory.get").
+		Assign("alice", "admin").
+		Assign("bob", "clerk")
+*/
+type RolePolicy struct {
+	lock    sync.RWMutex
+	roles   map[string][]string
+	callers map[string][]string
+}
+
+// NewRolePolicy returns a policy with no roles, which refuses everything.
+func NewRolePolicy() *RolePolicy {
+	return &RolePolicy{
+		roles:   make(map[string][]string),
+		callers: make(map[string][]string),
+	}
+}
+
+// Grant gives a role some permissions. It returns the policy so calls can be chained.
+func (policy *RolePolicy) Grant(role string, permissions ...string) *RolePolicy {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+	policy.roles[role] = append(policy.roles[role], permissions...)
+	return policy
+}
+
+// Assign gives a caller some roles. It returns the policy so calls can be chained.
+func (policy *RolePolicy) Assign(caller string, roles ...string) *RolePolicy {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+	policy.callers[caller] = append(policy.callers[caller], roles...)
+	return policy
+}
+
+// Authorize allows the request if one of the caller's roles grants one of the permissions.
+func (policy *RolePolicy) Authorize(managerName string, request *Request, permissions []string) error {
+
+	caller := request.Metadata.Get(MetadataCaller)
+	if caller == "" {
+		return fmt.Errorf("%w: request has no caller", ErrForbidden)
+	}
+
+	policy.lock.RLock()
+	defer policy.lock.RUnlock()
+	for _, role := range policy.callers[caller] {
+		for _, granted := range policy.roles[role] {
+			for _, permission := range permissions {
+				if grants(granted, permission) {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%w: caller %s may not call %s", ErrForbidden, strconv.Quote(caller), strconv.Quote(request.Route))
+
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// grants returns whether a granted permission covers the permission asked for.
+func grants(granted string, permission string) bool {
+	if strings.HasSuffix(granted, "*") {
+		return strings.HasPrefix(permission, strings.TrimSuffix(granted, "*"))
+	}
+	return granted == permission
+}
+
+// authorize checks a request against the manager's authorizer before it is dispatched.
+// 	Attached is the route the request resolved to, or nil if it is going to the not found
+// 	handler.
+func (manager *Manager) authorize(request *Request, attached *routeRecord) error {
+
+	manager.stateLock.Lock()
+	authorizer := manager.authorizer
+	manager.stateLock.Unlock()
+
+	if authorizer == nil || (attached != nil && attached.options.public) {
+		return nil
+	}
+
+	permissions := []string{request.Route}
+	if attached != nil && len(attached.options.permissions) > 0 {
+		permissions = attached.options.permissions
+	}
+
+	err := authorizer.Authorize(manager.Name, request, permissions)
+	if err != nil && !errors.Is(err, ErrForbidden) {
+		err = fmt.Errorf("%w: %v", ErrForbidden, err)
+	}
+	return err
+
+}
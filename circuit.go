@@ -0,0 +1,382 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrCircuitOpen is wrapped by the error returned when a request is refused because a circuit
+// 	breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is where a circuit breaker is. A closed breaker lets everything through, an
+// 	open one refuses everything, and a half open one lets a few trial requests through to
+// 	decide whether to close again.
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// Defaults for the zero values of a CircuitPolicy
+const (
+	defaultCircuitWindow  = 20
+	defaultCircuitOpenFor = 5 * time.Second
+)
+
+////////////////////
+// CIRCUIT POLICY //
+////////////////////
+
+/*
+CircuitPolicy describes when a circuit breaker trips. The breaker looks at the outcome of the
+most recent calls, and opens once too many of them failed or were slow. While it's open,
+requests are refused as they are sent, with an error wrapping ErrCircuitOpen, rather than
+waiting in the queue just to fail. After OpenFor, the breaker lets HalfOpenCalls trial requests
+through. If they all succeed it closes again, otherwise it opens for another OpenFor.
+
+	manager.Attach("charge", charge, managers.Breaker(managers.CircuitPolicy{
+		Window:    20,
+		ErrorRate: 0.5,
+		SlowCall:  time.Second,
+		SlowRate:  0.8,
+		OpenFor:   10 * time.Second,
+	}))
+
+Only calls which reach the attached function count. Requests refused by the authorizer or a
+validator, or for routes which don't exist, never trip a breaker. Calls which return a Deferred
+count once it's completed (or its continuation finishes), timed from when the route was called.
+*/
+type CircuitPolicy struct {
+
+	// Window is how many of the most recent calls the rates are worked out over. Zero means 20.
+	Window int
+
+	// MinCalls is how many calls the window needs before the breaker can trip. Zero means
+	// 	the whole window.
+	MinCalls int
+
+	// ErrorRate trips the breaker once this fraction (between 0 and 1) of the calls in the
+	// 	window failed. Zero means errors never trip it.
+	ErrorRate float64
+
+	// Calls taking longer than SlowCall are slow. SlowRate trips the breaker once this fraction
+	// 	of the calls in the window were slow. Zero means latency never trips it.
+	SlowCall time.Duration
+	SlowRate float64
+
+	// OpenFor is how long the breaker stays open before letting trial calls through. Zero
+	// 	means 5 seconds.
+	OpenFor time.Duration
+
+	// HalfOpenCalls is how many trial calls are let through while half open. Zero means 1.
+	HalfOpenCalls int
+}
+
+// CircuitInfo is a point in time description of a circuit breaker.
+type CircuitInfo struct {
+	State CircuitState `json:"state"`
+
+	// The number of calls in the window, and the fraction of them which failed or were slow
+	Calls     int     `json:"calls"`
+	ErrorRate float64 `json:"errorRate"`
+	SlowRate  float64 `json:"slowRate"`
+
+	// When the breaker last opened, how many times it has opened, and how many requests
+	// 	it has refused
+	OpenedAt time.Time `json:"openedAt"`
+	Trips    uint64    `json:"trips"`
+	Rejected uint64    `json:"rejected"`
+}
+
+// Breaker annotates a route with a circuit breaker. Each route gets its own breaker, so a
+// 	failing route doesn't hold up the rest of the manager.
+func Breaker(policy CircuitPolicy) RouteOption {
+	return func(options *routeOptions) {
+		options.circuit = &policy
+	}
+}
+
+// SetCircuitBreaker puts a circuit breaker around the whole manager, covering every route.
+// 	Routes can have their own breakers as well (see Breaker), in which case a request has to
+// 	get through both. Setting a policy which trips on nothing (no ErrorRate or SlowRate)
+// 	removes the breaker.
+func (manager *Manager) SetCircuitBreaker(policy CircuitPolicy) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.circuit = newCircuitBreaker(policy)
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// circuitBreaker is the state of a single breaker. Everything is guarded by the owning
+// 	manager's stateLock.
+type circuitBreaker struct {
+	policy CircuitPolicy
+	state  CircuitState
+
+	// The outcomes of the most recent calls, as a ring once the window is full
+	outcomes []circuitOutcome
+	next     int
+
+	// When the breaker opened, and the trial calls let through and passed while half open
+	openedAt  time.Time
+	trials    int
+	successes int
+
+	trips    uint64
+	rejected uint64
+}
+
+// circuitOutcome is how a single call went
+type circuitOutcome struct {
+	failed bool
+	slow   bool
+}
+
+// newCircuitBreaker returns a closed breaker with the policy's defaults filled in, or nil
+// 	if the policy would never trip.
+func newCircuitBreaker(policy CircuitPolicy) *circuitBreaker {
+
+	if policy.ErrorRate <= 0 && (policy.SlowRate <= 0 || policy.SlowCall <= 0) {
+		return nil
+	}
+	if policy.Window <= 0 {
+		policy.Window = defaultCircuitWindow
+	}
+	if policy.MinCalls <= 0 || policy.MinCalls > policy.Window {
+		policy.MinCalls = policy.Window
+	}
+	if policy.OpenFor <= 0 {
+		policy.OpenFor = defaultCircuitOpenFor
+	}
+	if policy.HalfOpenCalls <= 0 {
+		policy.HalfOpenCalls = 1
+	}
+	return &circuitBreaker{policy: policy, state: CircuitClosed}
+
+}
+
+// refresh moves an open breaker to half open once it has been open long enough.
+func (breaker *circuitBreaker) refresh(now time.Time) {
+	if breaker.state == CircuitOpen && now.Sub(breaker.openedAt) >= breaker.policy.OpenFor {
+		breaker.state = CircuitHalfOpen
+		breaker.trials, breaker.successes = 0, 0
+	}
+}
+
+// ready returns whether the breaker would let a call through right now.
+func (breaker *circuitBreaker) ready(now time.Time) bool {
+	breaker.refresh(now)
+	switch breaker.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return breaker.trials < breaker.policy.HalfOpenCalls
+	}
+	return true
+}
+
+// admit lets a call through a breaker which is ready, counting it if it's a trial. It
+// 	returns whether it was.
+func (breaker *circuitBreaker) admit() bool {
+	if breaker.state == CircuitHalfOpen {
+		breaker.trials++
+		return true
+	}
+	return false
+}
+
+// circuitTrial is a trial call let through by a half open breaker, along with the number of
+// 	times the breaker had tripped at the time, so a trial from before the breaker last opened
+// 	is never handed back to it.
+type circuitTrial struct {
+	breaker *circuitBreaker
+	trips   uint64
+}
+
+// circuitPending is a call to a route which the breakers haven't heard the outcome of yet,
+// 	along with when the route was called.
+type circuitPending struct {
+	breakers []*circuitBreaker
+	started  time.Time
+}
+
+// record adds the outcome of a call, tripping or closing the breaker as needed.
+func (breaker *circuitBreaker) record(err error, elapsed time.Duration, now time.Time) {
+
+	outcome := circuitOutcome{
+		failed: err != nil,
+		slow:   breaker.policy.SlowCall > 0 && elapsed > breaker.policy.SlowCall,
+	}
+
+	switch breaker.state {
+
+	// A single bad trial opens the breaker again, and enough good ones close it
+	case CircuitHalfOpen:
+		if outcome.failed || outcome.slow {
+			breaker.trip(now)
+			return
+		}
+		breaker.successes++
+		if breaker.successes >= breaker.policy.HalfOpenCalls {
+			breaker.state = CircuitClosed
+		}
+
+	case CircuitClosed:
+		if len(breaker.outcomes) < breaker.policy.Window {
+			breaker.outcomes = append(breaker.outcomes, outcome)
+		} else {
+			breaker.outcomes[breaker.next] = outcome
+		}
+		breaker.next = (breaker.next + 1) % breaker.policy.Window
+
+		calls, errorRate, slowRate := breaker.rates()
+		if calls < breaker.policy.MinCalls {
+			return
+		}
+		if (breaker.policy.ErrorRate > 0 && errorRate >= breaker.policy.ErrorRate) ||
+			(breaker.policy.SlowRate > 0 && slowRate >= breaker.policy.SlowRate) {
+			breaker.trip(now)
+		}
+
+	}
+
+}
+
+// trip opens the breaker and starts a fresh window for when it closes again.
+func (breaker *circuitBreaker) trip(now time.Time) {
+	breaker.state = CircuitOpen
+	breaker.openedAt = now
+	breaker.trips++
+	breaker.outcomes, breaker.next = breaker.outcomes[:0], 0
+}
+
+// rates returns the number of calls in the window and the fraction which failed and were slow.
+func (breaker *circuitBreaker) rates() (int, float64, float64) {
+	calls := len(breaker.outcomes)
+	if calls == 0 {
+		return 0, 0, 0
+	}
+	failed, slow := 0, 0
+	for _, outcome := range breaker.outcomes {
+		if outcome.failed {
+			failed++
+		}
+		if outcome.slow {
+			slow++
+		}
+	}
+	return calls, float64(failed) / float64(calls), float64(slow) / float64(calls)
+}
+
+// info describes the breaker.
+func (breaker *circuitBreaker) info(now time.Time) *CircuitInfo {
+	breaker.refresh(now)
+	calls, errorRate, slowRate := breaker.rates()
+	return &CircuitInfo{
+		State:     breaker.state,
+		Calls:     calls,
+		ErrorRate: errorRate,
+		SlowRate:  slowRate,
+		OpenedAt:  breaker.openedAt,
+		Trips:     breaker.trips,
+		Rejected:  breaker.rejected,
+	}
+}
+
+// admitRequest checks a request against the manager's breaker and its route's breaker as it
+// 	is sent. Internal requests and continuations of requests which already got through are
+// 	always let through.
+func (manager *Manager) admitRequest(request *Request) error {
+
+	if request.continuation != nil || strings.HasPrefix(request.Route, "state|") {
+		return nil
+	}
+	attached, _ := manager.resolve(request.Route)
+
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+
+	breakers := []*circuitBreaker{manager.circuit}
+	if attached != nil {
+		breakers = append(breakers, attached.circuit)
+	}
+
+	// Only let the request through if every breaker is ready, so a refusal from one doesn't
+	// 	use up a trial call on the other.
+	now := time.Now()
+	for _, breaker := range breakers {
+		if breaker != nil && !breaker.ready(now) {
+			breaker.rejected++
+			return newRequestError("send", manager.Name, request, ErrCircuitOpen)
+		}
+	}
+	for _, breaker := range breakers {
+		if breaker != nil && breaker.admit() {
+			request.trials = append(request.trials, circuitTrial{breaker: breaker, trips: breaker.trips})
+		}
+	}
+	return nil
+
+}
+
+// releaseTrials hands back the trial calls a request was let through with, if it's answered
+// 	without ever reaching its route (because it was refused, invalid, expired or the manager
+// 	stopped). Those say nothing about whether the route works, and a half open breaker which
+// 	never hears back about its trials would refuse everything from then on. Requests which
+// 	reached their route already gave their trials back by recording the outcome.
+func (manager *Manager) releaseTrials(request *Request) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.releaseTrialsLocked(request)
+}
+
+// releaseTrialsLocked is releaseTrials for callers already holding stateLock. A request
+// 	answered without finishing its call, such as a continuation refused as the manager
+// 	stops, never records an outcome either.
+func (manager *Manager) releaseTrialsLocked(request *Request) {
+
+	for _, trial := range request.trials {
+		breaker := trial.breaker
+		if breaker.state == CircuitHalfOpen && breaker.trips == trial.trips && breaker.trials > 0 {
+			breaker.trials--
+		}
+	}
+	request.trials = nil
+	request.pending = nil
+
+}
+
+// recordOutcome tells the breakers which let a Deferred request through how it went, once
+// 	the deferred is completed. The call is timed from when the route was called.
+func (manager *Manager) recordOutcome(request *Request, err error) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.recordOutcomeLocked(request, err, time.Now())
+}
+
+// recordOutcomeLocked is recordOutcome for callers already holding stateLock. Recording
+// 	the outcome also hands back any trials the request was let through with.
+func (manager *Manager) recordOutcomeLocked(request *Request, err error, now time.Time) {
+
+	pending := request.pending
+	if pending == nil {
+		manager.releaseTrialsLocked(request)
+		return
+	}
+	request.pending, request.trials = nil, nil
+	for _, breaker := range pending.breakers {
+		if breaker != nil {
+			breaker.record(err, now.Sub(pending.started), now)
+		}
+	}
+
+}
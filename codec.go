@@ -0,0 +1,780 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownType is returned when encoding a value whose type wasn't registered, or
+	// 	decoding an envelope naming a type which wasn't registered.
+	ErrUnknownType = errors.New("type not registered")
+
+	// ErrUnknownCodec is returned when a codec is asked for by name and doesn't exist.
+	ErrUnknownCodec = errors.New("codec not registered")
+
+	// ErrEnvelope is returned when bytes can't be read as an envelope, including envelopes
+	// 	written with a newer version of the format.
+	ErrEnvelope = errors.New("malformed envelope")
+)
+
+// EnvelopeVersion is the version of the envelope format written by Encode. Envelopes with
+// 	a higher version are refused rather than misread.
+const EnvelopeVersion = 1
+
+// envelopeMagic starts every envelope so stray bytes are caught early
+const envelopeMagic = 0xA7
+
+///////////
+// CODEC //
+///////////
+
+// Codec turns values into bytes and back. Unmarshal is given a pointer to a new value of the
+// 	type the data was encoded from.
+type Codec interface {
+	Name() string
+	Marshal(value any) ([]byte, error)
+	Unmarshal(data []byte, target any) error
+}
+
+// JSONCodec encodes with encoding/json. It is the default codec.
+type JSONCodec struct{}
+
+// Name returns "json".
+func (JSONCodec) Name() string { return "json" }
+
+// Marshal encodes the value as JSON.
+func (JSONCodec) Marshal(value any) ([]byte, error) { return json.Marshal(value) }
+
+// Unmarshal decodes JSON into the target.
+func (JSONCodec) Unmarshal(data []byte, target any) error { return json.Unmarshal(data, target) }
+
+// GobCodec encodes with encoding/gob. Types registered with RegisterType are registered with
+// 	gob as well, so they can be carried inside interface values (like a map[string]any).
+type GobCodec struct{}
+
+// Name returns "gob".
+func (GobCodec) Name() string { return "gob" }
+
+// Marshal encodes the value with gob.
+func (GobCodec) Marshal(value any) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	err := gob.NewEncoder(&buffer).Encode(value)
+	return buffer.Bytes(), err
+}
+
+// Unmarshal decodes gob data into the target.
+func (GobCodec) Unmarshal(data []byte, target any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(target)
+}
+
+/*
+BinaryCodec is a compact, self describing binary encoding for plain data: nil, booleans,
+integers, floats, strings, byte slices, time.Time, and slices and string keyed maps of those
+(like []any, []string, map[string]any and map[string]string). Integers are written as varints,
+so small numbers take a single byte. Structs aren't supported; use JSON or gob for those.
+*/
+type BinaryCodec struct{}
+
+// Name returns "binary".
+func (BinaryCodec) Name() string { return "binary" }
+
+// Marshal encodes the value.
+func (BinaryCodec) Marshal(value any) ([]byte, error) {
+	writer := &binaryWriter{}
+	if err := writer.value(reflect.ValueOf(value)); err != nil {
+		return nil, err
+	}
+	return writer.buffer.Bytes(), nil
+}
+
+// Unmarshal decodes the data into the target, converting numbers to the target's type. Numbers
+// 	which don't fit the target's type are refused rather than wrapped or truncated.
+func (BinaryCodec) Unmarshal(data []byte, target any) error {
+	reader := &binaryReader{data: data}
+	value, err := reader.value()
+	if err != nil {
+		return err
+	}
+	if reader.position != len(data) {
+		return fmt.Errorf("%w: %d trailing bytes", ErrEnvelope, len(data)-reader.position)
+	}
+	return assign(reflect.ValueOf(target).Elem(), value)
+}
+
+//////////////
+// REGISTRY //
+//////////////
+
+/*
+CodecRegistry picks a codec for each value and wraps the encoded bytes in a versioned envelope
+recording the codec and the value's registered type name, so the bytes can be decoded back into
+the same Go type without knowing anything else about them.
+
+The codec is chosen by route first (UseForRoute), then by the value's type (UseForType), and
+otherwise the default codec (JSON) is used. Types have to be registered under a name before they
+can be encoded. The basic types (strings, numbers, booleans, []byte, []any, map[string]any, and
+so on) are registered already. Putting a version in a type's name ("order/v2") lets old and new
+shapes of a type live side by side.
+*/
+type CodecRegistry struct {
+	lock      sync.RWMutex
+	codecs    map[string]Codec
+	routes    map[string]string
+	types     map[reflect.Type]string
+	names     map[reflect.Type]string
+	kinds     map[string]reflect.Type
+	defaultTo string
+}
+
+// Codecs is the registry used by the package level codec functions.
+var Codecs = NewCodecRegistry()
+
+// NewCodecRegistry returns a registry with the JSON, gob and binary codecs and the basic
+// 	types registered (with gob too, so they can be carried inside interface values).
+func NewCodecRegistry() *CodecRegistry {
+
+	registry := &CodecRegistry{
+		codecs:    make(map[string]Codec),
+		routes:    make(map[string]string),
+		types:     make(map[reflect.Type]string),
+		names:     make(map[reflect.Type]string),
+		kinds:     make(map[string]reflect.Type),
+		defaultTo: JSONCodec{}.Name(),
+	}
+	registry.Register(JSONCodec{})
+	registry.Register(GobCodec{})
+	registry.Register(BinaryCodec{})
+
+	for _, example := range []any{
+		false, "", []byte(nil), time.Time{},
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0),
+		[]any(nil), []string(nil), map[string]any(nil), map[string]string(nil),
+	} {
+		kind := reflect.TypeOf(example)
+		registry.names[kind] = kind.String()
+		registry.kinds[kind.String()] = kind
+		gob.Register(example)
+	}
+	return registry
+
+}
+
+// Register adds a codec, replacing any codec with the same name.
+func (registry *CodecRegistry) Register(codec Codec) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.codecs[codec.Name()] = codec
+}
+
+// SetDefault sets the codec used when neither the route nor the type picks one.
+func (registry *CodecRegistry) SetDefault(codecName string) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, ok := registry.codecs[codecName]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCodec, codecName)
+	}
+	registry.defaultTo = codecName
+	return nil
+}
+
+// UseForRoute encodes the data of a route with the named codec.
+func (registry *CodecRegistry) UseForRoute(route string, codecName string) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, ok := registry.codecs[codecName]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCodec, codecName)
+	}
+	registry.routes[route] = codecName
+	return nil
+}
+
+// UseForType encodes values of the example's type with the named codec.
+func (registry *CodecRegistry) UseForType(example any, codecName string) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, ok := registry.codecs[codecName]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCodec, codecName)
+	}
+	registry.types[reflect.TypeOf(example)] = codecName
+	return nil
+}
+
+// RegisterType registers the example's type under a name so it can be encoded and decoded.
+// 	The type is registered with gob under the same name. A name or type can only be
+// 	registered once.
+func (registry *CodecRegistry) RegisterType(name string, example any) (err error) {
+
+	kind := reflect.TypeOf(example)
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if existing, ok := registry.kinds[name]; ok && existing != kind {
+		return fmt.Errorf("type name %s is already registered to %v", name, existing)
+	}
+	if existing, ok := registry.names[kind]; ok && existing != name {
+		return fmt.Errorf("type %v is already registered as %s", kind, existing)
+	}
+
+	// Gob panics on conflicting registrations, which is just an error here
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("registering %s with gob: %v", name, recovered)
+		}
+	}()
+	gob.RegisterName(name, example)
+
+	registry.names[kind] = name
+	registry.kinds[name] = kind
+	return nil
+
+}
+
+// Encode encodes a value into an envelope, using the codec for the route (which may be empty).
+func (registry *CodecRegistry) Encode(route string, value any) ([]byte, error) {
+
+	envelope := &bytes.Buffer{}
+	envelope.WriteByte(envelopeMagic)
+	envelope.WriteByte(EnvelopeVersion)
+
+	// Nil is encoded without a codec or a type
+	if value == nil {
+		writeString(envelope, "")
+		writeString(envelope, "")
+		return envelope.Bytes(), nil
+	}
+
+	codec, name, err := registry.pick(route, reflect.TypeOf(value))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := codec.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s with %s: %w", name, codec.Name(), err)
+	}
+
+	writeString(envelope, codec.Name())
+	writeString(envelope, name)
+	envelope.Write(payload)
+	return envelope.Bytes(), nil
+
+}
+
+// Decode decodes an envelope back into a value of the type it was encoded from.
+func (registry *CodecRegistry) Decode(data []byte) (any, error) {
+
+	if len(data) < 2 || data[0] != envelopeMagic {
+		return nil, ErrEnvelope
+	}
+	if data[1] > EnvelopeVersion {
+		return nil, fmt.Errorf("%w: version %d is newer than %d", ErrEnvelope, data[1], EnvelopeVersion)
+	}
+	reader := &binaryReader{data: data, position: 2}
+	codecName, err := reader.string()
+	if err != nil {
+		return nil, err
+	}
+	name, err := reader.string()
+	if err != nil {
+		return nil, err
+	}
+	if codecName == "" && name == "" {
+		return nil, nil
+	}
+
+	registry.lock.RLock()
+	codec, codecFound := registry.codecs[codecName]
+	kind, kindFound := registry.kinds[name]
+	registry.lock.RUnlock()
+	if !codecFound {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, codecName)
+	}
+	if !kindFound {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, name)
+	}
+
+	target := reflect.New(kind)
+	if err := codec.Unmarshal(data[reader.position:], target.Interface()); err != nil {
+		return nil, fmt.Errorf("decoding %s with %s: %w", name, codecName, err)
+	}
+	return target.Elem().Interface(), nil
+
+}
+
+// EncodeRequest encodes a request's route, metadata and data, for sending to another process.
+func (registry *CodecRegistry) EncodeRequest(request *Request) ([]byte, error) {
+
+	data, err := registry.Encode(request.Route, request.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := &bytes.Buffer{}
+	writeString(frame, request.Route)
+	keys := make([]string, 0, len(request.Metadata))
+	for key := range request.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeLength(frame, len(keys))
+	for _, key := range keys {
+		writeString(frame, key)
+		writeString(frame, request.Metadata[key])
+	}
+	frame.Write(data)
+	return frame.Bytes(), nil
+
+}
+
+// DecodeRequest decodes a request written by EncodeRequest. The request keeps the metadata
+// 	(including the id) it was sent with, and is ready to be sent to a manager.
+func (registry *CodecRegistry) DecodeRequest(frame []byte) (*Request, error) {
+
+	reader := &binaryReader{data: frame}
+	route, err := reader.string()
+	if err != nil {
+		return nil, err
+	}
+	count, err := reader.length()
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(Metadata, count)
+	for i := 0; i < count; i++ {
+		key, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+		if metadata[key], err = reader.string(); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := registry.Decode(frame[reader.position:])
+	if err != nil {
+		return nil, err
+	}
+	request := NewRequest(route, data)
+	request.Metadata = metadata
+	return request, nil
+
+}
+
+// EncodeResponse encodes the result of a request. Errors are carried as their message.
+func (registry *CodecRegistry) EncodeResponse(route string, data any, err error) ([]byte, error) {
+
+	frame := &bytes.Buffer{}
+	if err != nil {
+		frame.WriteByte(1)
+		writeString(frame, err.Error())
+		return frame.Bytes(), nil
+	}
+
+	encoded, err := registry.Encode(route, data)
+	if err != nil {
+		return nil, err
+	}
+	frame.WriteByte(0)
+	frame.Write(encoded)
+	return frame.Bytes(), nil
+
+}
+
+// DecodeResponse decodes a response written by EncodeResponse. A failed request comes back
+// 	as an error with the same message.
+func (registry *CodecRegistry) DecodeResponse(frame []byte) (any, error) {
+
+	if len(frame) == 0 {
+		return nil, ErrEnvelope
+	}
+	if frame[0] == 1 {
+		reader := &binaryReader{data: frame, position: 1}
+		message, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New(message)
+	}
+	return registry.Decode(frame[1:])
+
+}
+
+// RegisterType registers a type with the default registry. See CodecRegistry.RegisterType.
+func RegisterType(name string, example any) error {
+	return Codecs.RegisterType(name, example)
+}
+
+// Encode encodes a value with the default registry. See CodecRegistry.Encode.
+func Encode(route string, value any) ([]byte, error) {
+	return Codecs.Encode(route, value)
+}
+
+// Decode decodes a value with the default registry. See CodecRegistry.Decode.
+func Decode(data []byte) (any, error) {
+	return Codecs.Decode(data)
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// pick chooses the codec for a value and looks up its registered type name.
+func (registry *CodecRegistry) pick(route string, kind reflect.Type) (Codec, string, error) {
+
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	name, ok := registry.names[kind]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnknownType, kind)
+	}
+
+	codecName := registry.defaultTo
+	if byType, ok := registry.types[kind]; ok {
+		codecName = byType
+	}
+	if byRoute, ok := registry.routes[route]; ok && route != "" {
+		codecName = byRoute
+	}
+	return registry.codecs[codecName], name, nil
+
+}
+
+// The type tags of the binary codec
+const (
+	binaryNil byte = iota
+	binaryFalse
+	binaryTrue
+	binaryInt
+	binaryUint
+	binaryFloat
+	binaryString
+	binaryBytes
+	binaryList
+	binaryMap
+	binaryTime
+)
+
+// binaryWriter builds up the output of the binary codec
+type binaryWriter struct {
+	buffer bytes.Buffer
+}
+
+// value writes a single tagged value.
+func (writer *binaryWriter) value(value reflect.Value) error {
+
+	buffer := &writer.buffer
+	if !value.IsValid() {
+		buffer.WriteByte(binaryNil)
+		return nil
+	}
+	if value.Type() == reflect.TypeOf(time.Time{}) {
+		encoded, err := value.Interface().(time.Time).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		buffer.WriteByte(binaryTime)
+		writeBytes(buffer, encoded)
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if value.IsNil() {
+			buffer.WriteByte(binaryNil)
+			return nil
+		}
+		return writer.value(value.Elem())
+	case reflect.Bool:
+		if value.Bool() {
+			buffer.WriteByte(binaryTrue)
+		} else {
+			buffer.WriteByte(binaryFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buffer.WriteByte(binaryInt)
+		writeVarint(buffer, value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buffer.WriteByte(binaryUint)
+		writeUvarint(buffer, value.Uint())
+	case reflect.Float32, reflect.Float64:
+		buffer.WriteByte(binaryFloat)
+		bits := make([]byte, 8)
+		binary.BigEndian.PutUint64(bits, math.Float64bits(value.Float()))
+		buffer.Write(bits)
+	case reflect.String:
+		buffer.WriteByte(binaryString)
+		writeString(buffer, value.String())
+	case reflect.Slice, reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			buffer.WriteByte(binaryBytes)
+			data := make([]byte, value.Len())
+			reflect.Copy(reflect.ValueOf(data), value)
+			writeBytes(buffer, data)
+			return nil
+		}
+		buffer.WriteByte(binaryList)
+		writeLength(buffer, value.Len())
+		for i := 0; i < value.Len(); i++ {
+			if err := writer.value(value.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("binary codec can't encode %v: map keys must be strings", value.Type())
+		}
+		keys := value.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		buffer.WriteByte(binaryMap)
+		writeLength(buffer, len(keys))
+		for _, key := range keys {
+			writeString(buffer, key.String())
+			if err := writer.value(value.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("binary codec can't encode %v", value.Type())
+	}
+	return nil
+
+}
+
+// binaryReader reads back what the binary codec (and the envelope) wrote
+type binaryReader struct {
+	data     []byte
+	position int
+}
+
+// value reads a single tagged value. Lists come back as []any and maps as map[string]any.
+func (reader *binaryReader) value() (any, error) {
+
+	if reader.position >= len(reader.data) {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrEnvelope)
+	}
+	tag := reader.data[reader.position]
+	reader.position++
+
+	switch tag {
+	case binaryNil:
+		return nil, nil
+	case binaryFalse:
+		return false, nil
+	case binaryTrue:
+		return true, nil
+	case binaryInt:
+		number, size := binary.Varint(reader.data[reader.position:])
+		if size <= 0 {
+			return nil, fmt.Errorf("%w: bad integer", ErrEnvelope)
+		}
+		reader.position += size
+		return number, nil
+	case binaryUint:
+		number, size := binary.Uvarint(reader.data[reader.position:])
+		if size <= 0 {
+			return nil, fmt.Errorf("%w: bad integer", ErrEnvelope)
+		}
+		reader.position += size
+		return number, nil
+	case binaryFloat:
+		if reader.position+8 > len(reader.data) {
+			return nil, fmt.Errorf("%w: bad float", ErrEnvelope)
+		}
+		bits := binary.BigEndian.Uint64(reader.data[reader.position:])
+		reader.position += 8
+		return math.Float64frombits(bits), nil
+	case binaryString:
+		return reader.string()
+	case binaryBytes:
+		return reader.bytes()
+	case binaryTime:
+		encoded, err := reader.bytes()
+		if err != nil {
+			return nil, err
+		}
+		moment := time.Time{}
+		err = moment.UnmarshalBinary(encoded)
+		return moment, err
+	case binaryList:
+		count, err := reader.length()
+		if err != nil {
+			return nil, err
+		}
+		list := make([]any, count)
+		for i := range list {
+			if list[i], err = reader.value(); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case binaryMap:
+		count, err := reader.length()
+		if err != nil {
+			return nil, err
+		}
+		object := make(map[string]any, count)
+		for i := 0; i < count; i++ {
+			key, err := reader.string()
+			if err != nil {
+				return nil, err
+			}
+			if object[key], err = reader.value(); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	}
+	return nil, fmt.Errorf("%w: unknown tag %d", ErrEnvelope, tag)
+
+}
+
+// length reads a uvarint length, making sure it fits in what's left of the data.
+func (reader *binaryReader) length() (int, error) {
+	length, size := binary.Uvarint(reader.data[reader.position:])
+	if size <= 0 || length > uint64(len(reader.data)) {
+		return 0, fmt.Errorf("%w: bad length", ErrEnvelope)
+	}
+	reader.position += size
+	return int(length), nil
+}
+
+// bytes reads a length prefixed run of bytes.
+func (reader *binaryReader) bytes() ([]byte, error) {
+	length, err := reader.length()
+	if err != nil {
+		return nil, err
+	}
+	if reader.position+length > len(reader.data) {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrEnvelope)
+	}
+	data := append([]byte{}, reader.data[reader.position:reader.position+length]...)
+	reader.position += length
+	return data, nil
+}
+
+// string reads a length prefixed string.
+func (reader *binaryReader) string() (string, error) {
+	data, err := reader.bytes()
+	return string(data), err
+}
+
+// writeLength writes a uvarint length.
+func writeLength(buffer *bytes.Buffer, length int) {
+	writeUvarint(buffer, uint64(length))
+}
+
+// writeUvarint writes an unsigned varint.
+func writeUvarint(buffer *bytes.Buffer, number uint64) {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(encoded[:binary.PutUvarint(encoded, number)])
+}
+
+// writeVarint writes a signed varint.
+func writeVarint(buffer *bytes.Buffer, number int64) {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(encoded[:binary.PutVarint(encoded, number)])
+}
+
+// writeBytes writes a length prefixed run of bytes.
+func writeBytes(buffer *bytes.Buffer, data []byte) {
+	writeLength(buffer, len(data))
+	buffer.Write(data)
+}
+
+// writeString writes a length prefixed string.
+func writeString(buffer *bytes.Buffer, text string) {
+	writeLength(buffer, len(text))
+	buffer.WriteString(text)
+}
+
+// assign stores a decoded binary value into the target, converting where the types differ
+// 	(like an int64 into an int, or a []any into a []string).
+func assign(target reflect.Value, value any) error {
+
+	if value == nil {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+
+	source := reflect.ValueOf(value)
+	switch {
+	case source.Type().AssignableTo(target.Type()):
+		target.Set(source)
+	case target.Kind() == reflect.Slice && source.Kind() == reflect.Slice && target.Type().Elem().Kind() != reflect.Uint8:
+		slice := reflect.MakeSlice(target.Type(), source.Len(), source.Len())
+		for i := 0; i < source.Len(); i++ {
+			if err := assign(slice.Index(i), source.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		target.Set(slice)
+	case target.Kind() == reflect.Map && source.Kind() == reflect.Map:
+		object := reflect.MakeMapWithSize(target.Type(), source.Len())
+		for _, key := range source.MapKeys() {
+			item := reflect.New(target.Type().Elem()).Elem()
+			if err := assign(item, source.MapIndex(key).Interface()); err != nil {
+				return err
+			}
+			object.SetMapIndex(key.Convert(target.Type().Key()), item)
+		}
+		target.Set(object)
+	case isNumber(source.Kind()) && isNumber(target.Kind()):
+		if !fits(source, target) {
+			return fmt.Errorf("binary codec can't decode %v into %v without overflowing", source, target.Type())
+		}
+		target.Set(source.Convert(target.Type()))
+	default:
+		return fmt.Errorf("binary codec can't decode %v into %v", source.Type(), target.Type())
+	}
+	return nil
+
+}
+
+// isNumber returns whether a kind is an integer or float.
+func isNumber(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+// fits returns whether a number can be converted to the target's type without changing its
+// 	value. Floats only fit integers if they're whole.
+func fits(source reflect.Value, target reflect.Value) bool {
+
+	switch {
+	case target.CanInt():
+		switch {
+		case source.CanInt():
+			return !target.OverflowInt(source.Int())
+		case source.CanUint():
+			return source.Uint() <= math.MaxInt64 && !target.OverflowInt(int64(source.Uint()))
+		default:
+			number := source.Float()
+			return number == math.Trunc(number) && number >= math.MinInt64 && number < math.MaxInt64 && !target.OverflowInt(int64(number))
+		}
+	case target.CanUint():
+		switch {
+		case source.CanInt():
+			return source.Int() >= 0 && !target.OverflowUint(uint64(source.Int()))
+		case source.CanUint():
+			return !target.OverflowUint(source.Uint())
+		default:
+			number := source.Float()
+			return number == math.Trunc(number) && number >= 0 && number < math.MaxUint64 && !target.OverflowUint(uint64(number))
+		}
+	default:
+		return !source.CanFloat() || !target.OverflowFloat(source.Float())
+	}
+
+}
@@ -0,0 +1,206 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeadLetterReason is why a request ended up in a dead letter queue.
+type DeadLetterReason string
+
+const (
+	// DeadLetterError is a request whose route (or middleware, validator, authorizer, etc.)
+	// 	failed. Retried requests only get here once they run out of attempts.
+	DeadLetterError DeadLetterReason = "error"
+
+	// DeadLetterPanic is the request which was being processed when the manager panicked
+	DeadLetterPanic DeadLetterReason = "panic"
+
+	// DeadLetterTimeout is a request whose context ended before it could be processed
+	DeadLetterTimeout DeadLetterReason = "timeout"
+
+	// DeadLetterRejected is a request which was still queued when the manager stopped
+	DeadLetterRejected DeadLetterReason = "rejected"
+)
+
+/////////////////
+// DEAD LETTER //
+/////////////////
+
+// DeadLetter is a failed request, kept so that it can be looked at or replayed later.
+type DeadLetter struct {
+	ID       string
+	Manager  string
+	Route    string
+	Data     any
+	Metadata Metadata
+	Error    error
+	Reason   DeadLetterReason
+	Attempts int
+	Time     time.Time
+
+	// The manager the request failed on, so it can be replayed there
+	manager *Manager
+}
+
+/*
+DeadLetterQueue collects the requests a manager couldn't process. It is meant for fire and
+forget callers who never look at their responses, so failures aren't just printed and lost.
+
+	deadLetters := managers.NewDeadLetterQueue(1000)
+	manager.SetDeadLetterQueue(deadLetters)
+	...
+	for _, letter := range deadLetters.List() {
+		fmt.Println(letter.Route, letter.Reason, letter.Error)
+	}
+	deadLetters.ReplayAll()
+
+A queue can be shared by several managers. Replayed requests go back to the manager they failed on.
+*/
+type DeadLetterQueue struct {
+	lock    sync.Mutex
+	limit   int
+	letters []DeadLetter
+}
+
+// NewDeadLetterQueue returns an empty queue which holds at most limit letters, dropping the
+// 	oldest when it's full. A limit of zero or less means no limit.
+func NewDeadLetterQueue(limit int) *DeadLetterQueue {
+	return &DeadLetterQueue{limit: limit}
+}
+
+// SetDeadLetterQueue sets the queue the manager puts failed requests in. Setting nil (the
+// 	default) turns the dead letter queue off.
+func (manager *Manager) SetDeadLetterQueue(queue *DeadLetterQueue) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.deadLetters = queue
+}
+
+// List returns a copy of every letter in the queue, oldest first.
+func (queue *DeadLetterQueue) List() []DeadLetter {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return append([]DeadLetter{}, queue.letters...)
+}
+
+// Len returns the number of letters in the queue.
+func (queue *DeadLetterQueue) Len() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.letters)
+}
+
+// Get returns the letter for a request id.
+func (queue *DeadLetterQueue) Get(id string) (DeadLetter, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for _, letter := range queue.letters {
+		if letter.ID == id {
+			return letter, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// Replay takes a letter out of the queue and sends its request to the manager again. The
+// 	new request has the same route, data and metadata (including the id). If it fails again,
+// 	it will end up back in the queue.
+func (queue *DeadLetterQueue) Replay(id string) (*Request, bool) {
+	letter, ok := queue.take(func(letter DeadLetter) bool { return letter.ID == id })
+	if !ok {
+		return nil, false
+	}
+	return letter[0].replay(), true
+}
+
+// ReplayAll replays every letter in the queue, oldest first, and returns the new requests.
+func (queue *DeadLetterQueue) ReplayAll() []*Request {
+	letters, _ := queue.take(func(DeadLetter) bool { return true })
+	requests := make([]*Request, len(letters))
+	for i, letter := range letters {
+		requests[i] = letter.replay()
+	}
+	return requests
+}
+
+// Purge removes every letter from the queue and returns how many there were.
+func (queue *DeadLetterQueue) Purge() int {
+	letters, _ := queue.take(func(DeadLetter) bool { return true })
+	return len(letters)
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// add puts a letter at the end of the queue, dropping the oldest if it's full.
+func (queue *DeadLetterQueue) add(letter DeadLetter) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.letters = append(queue.letters, letter)
+	if queue.limit > 0 && len(queue.letters) > queue.limit {
+		queue.letters = append([]DeadLetter{}, queue.letters[len(queue.letters)-queue.limit:]...)
+	}
+}
+
+// take removes and returns the letters matching the filter.
+func (queue *DeadLetterQueue) take(filter func(DeadLetter) bool) ([]DeadLetter, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	taken, kept := []DeadLetter{}, queue.letters[:0]
+	for _, letter := range queue.letters {
+		if filter(letter) {
+			taken = append(taken, letter)
+		} else {
+			kept = append(kept, letter)
+		}
+	}
+	queue.letters = kept
+	return taken, len(taken) > 0
+}
+
+// replay sends the letter's request to its manager again.
+func (letter DeadLetter) replay() *Request {
+	request := NewRequest(letter.Route, letter.Data)
+	request.Metadata = letter.Metadata.Clone()
+	letter.manager.SendRequest(request)
+	return request
+}
+
+// deadLetter puts a failed request in the manager's dead letter queue, if it has one.
+// 	Internal requests (kill, restart, etc.) are never dead lettered.
+func (manager *Manager) deadLetter(request *Request, reason DeadLetterReason, err error) {
+
+	manager.stateLock.Lock()
+	queue := manager.deadLetters
+	manager.stateLock.Unlock()
+	if queue == nil || strings.HasPrefix(request.Route, "state|") {
+		return
+	}
+
+	if reason == DeadLetterError && (errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)) {
+		reason = DeadLetterTimeout
+	}
+	if reason == DeadLetterError && errors.Is(err, ErrPanic) {
+		reason = DeadLetterPanic
+	}
+	queue.add(DeadLetter{
+		ID:       request.ID(),
+		Manager:  manager.Name,
+		Route:    request.Route,
+		Data:     request.Data,
+		Metadata: request.Metadata.Clone(),
+		Error:    err,
+		Reason:   reason,
+		Attempts: request.Attempt(),
+		Time:     time.Now(),
+		manager:  manager,
+	})
+
+}
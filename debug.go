@@ -0,0 +1,104 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+/*
+DebugHandler returns an http.Handler which shows the live state of every manager in the
+public map. Nothing is served unless you mount it yourself, for example:
+
+	http.Handle("/debug/managers", managers.DebugHandler())
+
+The page is rendered as HTML by default. Ask for "?format=json" (or send an Accept header
+of "application/json") to get the same data as JSON. Adding "?manager=<name>" limits the
+output to a single manager.
+*/
+func DebugHandler() http.Handler {
+	return http.HandlerFunc(serveDebug)
+}
+
+// serveDebug collects the manager info and renders it in the requested format.
+func serveDebug(writer http.ResponseWriter, request *http.Request) {
+
+	// Collect the managers, filtering down to one if asked
+	infos := List()
+	if name := request.URL.Query().Get("manager"); name != "" {
+		filtered := []ManagerInfo{}
+		for _, info := range infos {
+			if info.Name == name {
+				filtered = append(filtered, info)
+			}
+		}
+		infos = filtered
+	}
+
+	// JSON output
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(infos); err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// HTML output
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(writer, infos); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// wantsJSON checks whether the debug request asked for JSON instead of HTML.
+func wantsJSON(request *http.Request) bool {
+	if format := request.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+// debugTemplate is the HTML page served by DebugHandler.
+var debugTemplate = template.Must(template.New("managers").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Managers</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+.busy { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Managers</h1>
+{{range .}}
+<h2>{{.Name}}</h2>
+<p>
+State: {{.State}}{{if .Running}} (up {{.Uptime}}){{end}}<br>
+Queue: {{.QueueLength}} / {{.QueueCapacity}}<br>
+{{if .CurrentRoute}}<span class="busy">Processing: {{.CurrentRoute}} for {{.CurrentElapsed}}</span>{{else}}Idle{{end}}
+</p>
+<table>
+<tr><th>Route</th><th>Calls</th><th>Errors</th><th>Average</th><th>Min</th><th>Max</th><th>Last Called</th></tr>
+{{range .Routes}}<tr><td>{{.Route}}</td><td>{{.Calls}}</td><td>{{.Errors}}</td><td>{{.AverageDuration}}</td><td>{{.MinDuration}}</td><td>{{.MaxDuration}}</td><td>{{if not .LastCalled.IsZero}}{{.LastCalled.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+{{end}}</table>
+{{if .RecentErrors}}
+<table>
+<tr><th>Time</th><th>Route</th><th>Error</th></tr>
+{{range .RecentErrors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Route}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+{{else}}
+<p>No managers.</p>
+{{end}}
+</body>
+</html>
+`))
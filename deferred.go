@@ -0,0 +1,140 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"sync"
+)
+
+//////////////
+// DEFERRED //
+//////////////
+
+/*
+Deferred lets an attached function finish a request later, without holding up the processing
+loop. This is meant for routes which need to wait on I/O. The function starts the work (in its
+own goroutine), returns the Deferred, and the manager moves on to the next request. Whoever is
+waiting on the request keeps waiting until the Deferred is completed.
+
+There are three ways to complete a Deferred, and only the first one counts:
+
+	deferred.Complete(data)        // Respond with data (an error is treated like Fail)
+	deferred.Fail(err)             // Respond with an error
+	deferred.Continue(function)    // Run function inside the manager and respond with its result
+
+Continue is how the result of the I/O gets back into the manager state safely. The function is
+queued on the manager like any other request, so it runs inside the processing goroutine and
+can do anything an attached function can (including returning another Deferred).
+*/
+type Deferred struct {
+	lock sync.Mutex
+
+	// The manager and request the deferred belongs to. These are set by the manager once
+	// 	the attached function returns.
+	manager *Manager
+	request *Request
+
+	// How the deferred was completed. If it was completed before it was bound to a
+	// 	request, this is held onto until the manager binds it.
+	completed    bool
+	response     responseStruct
+	continuation func(managerState any) any
+}
+
+// NewDeferred returns a deferred for an attached function to return.
+func NewDeferred() *Deferred {
+	return &Deferred{}
+}
+
+// Complete finishes the request with the given data. If data is an error, this is the
+// 	same as Fail.
+func (deferred *Deferred) Complete(data any) {
+	if err, ok := data.(error); ok {
+		deferred.Fail(err)
+		return
+	}
+	deferred.complete(responseStruct{Data: data}, nil)
+}
+
+// Fail finishes the request with the given error.
+func (deferred *Deferred) Fail(err error) {
+	deferred.complete(responseStruct{Error: err}, nil)
+}
+
+// Continue finishes the request by running function inside the manager. Whatever the
+// 	function returns is treated exactly like the return value of an attached function.
+func (deferred *Deferred) Continue(function func(managerState any) any) {
+	deferred.complete(responseStruct{}, function)
+}
+
+// IsComplete returns whether one of the completion functions has been called.
+func (deferred *Deferred) IsComplete() bool {
+	deferred.lock.Lock()
+	defer deferred.lock.Unlock()
+	return deferred.completed
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// complete records how the deferred finished and delivers it if the deferred has already
+// 	been bound to a request. Only the first call does anything.
+func (deferred *Deferred) complete(response responseStruct, continuation func(managerState any) any) {
+
+	deferred.lock.Lock()
+	if deferred.completed {
+		deferred.lock.Unlock()
+		return
+	}
+	deferred.completed = true
+	deferred.response = response
+	deferred.continuation = continuation
+	bound := deferred.request != nil
+	deferred.lock.Unlock()
+
+	if bound {
+		deferred.deliver()
+	}
+
+}
+
+// bind attaches the deferred to the request it is answering. This is called from inside
+// 	the processing loop once the attached function returns. If the deferred was already
+// 	completed, it is delivered right away.
+func (deferred *Deferred) bind(manager *Manager, request *Request) {
+
+	deferred.lock.Lock()
+	deferred.manager = manager
+	deferred.request = request
+	completed := deferred.completed
+	deferred.lock.Unlock()
+
+	if completed {
+		deferred.deliver()
+	}
+
+}
+
+// deliver answers the request, or queues the continuation on the manager. The continuation
+// 	is queued from its own goroutine so a full queue can never block the processing loop.
+func (deferred *Deferred) deliver() {
+
+	manager, request := deferred.manager, deferred.request
+
+	if deferred.continuation != nil {
+		request.continuation = deferred.continuation
+		go manager.SendRequest(request)
+		return
+	}
+
+	response := deferred.response
+	if response.Error != nil {
+		response.Error = newRequestError("process", manager.Name, request, response.Error)
+		manager.deadLetter(request, DeadLetterError, response.Error)
+	}
+	manager.recordOutcome(request, response.Error)
+	manager.acknowledge(request)
+	request.storeResponse(response)
+
+}
@@ -0,0 +1,568 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQueueClosed is returned when using a queue which has been closed.
+var ErrQueueClosed = errors.New("queue is closed")
+
+// SyncPolicy is how often a disk queue flushes its writes to the disk with fsync.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes every write before it returns, so a request is on the disk before
+	// 	Send returns. This is the safest and slowest policy, and the default.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval flushes on the first write after SyncEvery has passed since the last
+	// 	flush, and on Close. A crash can lose whatever was written since the last flush.
+	SyncInterval
+
+	// SyncNever leaves flushing up to the operating system. Requests survive the process
+	// 	dying, but not the machine.
+	SyncNever
+)
+
+// Defaults for the zero values of DiskQueueOptions
+const (
+	defaultSegmentSize = 16 << 20
+	defaultSyncEvery   = time.Second
+)
+
+// The kinds of record written to a segment
+const (
+	diskRecordRequest byte = 1
+	diskRecordAck     byte = 2
+)
+
+// DiskQueueOptions configures a disk queue. The zero value is ready to use.
+type DiskQueueOptions struct {
+
+	// SegmentSize is roughly how large a segment file grows before a new one is started.
+	// 	Zero means 16MB.
+	SegmentSize int64
+
+	// Sync is how often writes are flushed to the disk, and SyncEvery is the interval
+	// 	for SyncInterval. Zero means a second.
+	Sync      SyncPolicy
+	SyncEvery time.Duration
+}
+
+////////////////
+// DISK QUEUE //
+////////////////
+
+/*
+DiskQueue keeps a manager's requests on disk until they have been answered, so that requests
+which were accepted by Send survive the process dying. Requests are appended to segment files
+in a directory as they are sent, and acknowledged once the manager has answered them. When the
+queue is opened again, every request which was never acknowledged is delivered again.
+
+	queue, err := managers.OpenDiskQueue("/var/lib/app/payments", managers.DiskQueueOptions{})
+	...
+	manager, err := managers.NewManager("Payments", 0, managers.WithQueue(queue))
+
+A disk queue is a Queue in its own right, which holds any number of requests. It can also be
+put in front of whatever queue a manager already uses with Manager.SetDiskQueue, in which case
+it only keeps the requests on disk. A queue can be used either way, but not both.
+
+Delivery is at least once: a request which was being processed when the process died is
+processed again, so routes behind a disk queue should be safe to repeat (the request keeps its
+id, see Request.ID, which makes that easier). Request data is written with the package codecs
+(see Codecs), so the types sent to the manager have to be registered with RegisterType.
+
+Requests the manager refuses because it stopped (see ErrStopped) are answered, but stay on disk
+unacknowledged, so they are delivered again the next time the queue is opened rather than lost.
+Callers which send them again themselves may see them processed twice.
+
+Segments are removed once every request in them (and every older segment) is acknowledged. A
+queue belongs to a single manager. Internal requests (like the ones sent by Kill) are queued but
+never written to disk.
+*/
+type DiskQueue struct {
+	lock      sync.Mutex
+	directory string
+	options   DiskQueueOptions
+	closed    bool
+
+	// The segment being written to, and how large it is
+	file *os.File
+	size int64
+
+	// Every segment still on disk oldest first (the last is the one being written to), and
+	// 	the number of unacknowledged requests in each of them
+	segments []uint64
+	pending  map[uint64]int
+
+	// The segment each unacknowledged request is in, by sequence number, and the last
+	// 	sequence number handed out
+	records  map[uint64]uint64
+	sequence uint64
+
+	// The requests waiting to be dequeued, starting with the ones read back from the disk
+	// 	when the queue was opened
+	waiting *bufferedQueue
+
+	lastSync time.Time
+}
+
+// OpenDiskQueue opens the queue kept in the directory, creating it if needed. Requests left
+// 	over from before are read back, oldest first, ready to be dequeued again (or delivered
+// 	by Manager.SetDiskQueue). They are decoded with the package codecs, so their types need
+// 	to be registered before the queue is opened. A segment which ends in a partly written
+// 	record (from a crash in the middle of a write) is read up to that record.
+func OpenDiskQueue(directory string, options DiskQueueOptions) (*DiskQueue, error) {
+
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = defaultSegmentSize
+	}
+	if options.SyncEvery <= 0 {
+		options.SyncEvery = defaultSyncEvery
+	}
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, err
+	}
+
+	queue := &DiskQueue{
+		directory: directory,
+		options:   options,
+		pending:   map[uint64]int{},
+		records:   map[uint64]uint64{},
+		waiting:   newBufferedQueue(&ringBuffer{}, -1),
+		lastSync:  time.Now(),
+	}
+	if err := queue.load(); err != nil {
+		return nil, err
+	}
+
+	// New requests always go into a fresh segment, so nothing is ever written after a
+	// 	partly written record.
+	next := uint64(1)
+	if len(queue.segments) > 0 {
+		next = queue.segments[len(queue.segments)-1] + 1
+	}
+	if err := queue.startSegment(next); err != nil {
+		return nil, err
+	}
+	if err := queue.removeSegments(); err != nil {
+		queue.file.Close()
+		return nil, err
+	}
+	return queue, nil
+
+}
+
+// SetDiskQueue keeps the manager's requests in the disk queue from now on, in front of the
+// 	manager's own queue. Requests the disk queue recovered from the disk are sent to the
+// 	manager again (from another goroutine, so this doesn't block on a full queue) and
+// 	returned, so the caller can wait on them. Their original data, metadata and ids are
+// 	kept. Setting nil stops keeping requests on disk.
+func (manager *Manager) SetDiskQueue(queue *DiskQueue) ([]*Request, error) {
+
+	var requests []*Request
+	if queue != nil {
+		if requests = queue.waiting.clear(); queue.isClosed() {
+			return nil, newError("recover", manager.Name, "", ErrQueueClosed)
+		}
+	}
+
+	manager.stateLock.Lock()
+	manager.disk = queue
+	manager.stateLock.Unlock()
+
+	go func() {
+		for _, request := range requests {
+			request.queuedAt = time.Now()
+			if err := manager.queue.Enqueue(context.Background(), request); err != nil {
+				request.storeResponse(responseStruct{Error: newRequestError("send", manager.Name, request, err)})
+			}
+		}
+	}()
+	return requests, nil
+
+}
+
+// Enqueue writes the request to disk and queues it. Requests which are already on disk
+// 	(like retries) and internal requests are only queued.
+func (queue *DiskQueue) Enqueue(ctx context.Context, request *Request) error {
+	if err := queue.persist(request); err != nil {
+		return err
+	}
+	return queue.waiting.Enqueue(ctx, request)
+}
+
+// Dequeue removes the next request from the queue. It stays on disk until it's acknowledged.
+func (queue *DiskQueue) Dequeue(ctx context.Context) (*Request, error) {
+	return queue.waiting.Dequeue(ctx)
+}
+
+// Len returns the number of requests waiting to be dequeued.
+func (queue *DiskQueue) Len() int {
+	return queue.waiting.Len()
+}
+
+// Cap returns -1, a disk queue has no limit.
+func (queue *DiskQueue) Cap() int {
+	return -1
+}
+
+// Unacknowledged returns the number of requests on disk which haven't been acknowledged,
+// 	including the ones which have been dequeued and are still being processed.
+func (queue *DiskQueue) Unacknowledged() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.records)
+}
+
+// Close flushes and closes the queue. Requests which haven't been acknowledged stay on disk
+// 	and are delivered again the next time the queue is opened. Anything still waiting to be
+// 	dequeued is dropped from memory, and whoever is waiting on it is answered with an error
+// 	wrapping ErrQueueClosed.
+func (queue *DiskQueue) Close() error {
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if queue.closed {
+		return nil
+	}
+	queue.closed = true
+	queue.waiting.Close()
+	for _, request := range queue.waiting.clear() {
+		request.disk = nil
+		request.storeResponse(responseStruct{Error: newRequestError("dequeue", "", request, ErrQueueClosed)})
+	}
+	if err := queue.file.Sync(); err != nil {
+		queue.file.Close()
+		return err
+	}
+	return queue.file.Close()
+
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// persist writes a request to the manager's disk queue, if it has one, before it is queued.
+// 	Requests which are already on disk (like retries and continuations), and internal
+// 	requests, aren't written again.
+func (manager *Manager) persist(request *Request) error {
+
+	manager.stateLock.Lock()
+	queue := manager.disk
+	manager.stateLock.Unlock()
+	if queue == nil {
+		return nil
+	}
+	if err := queue.persist(request); err != nil {
+		return newRequestError("persist", manager.Name, request, err)
+	}
+	return nil
+
+}
+
+// persist writes a request to disk, unless it's already on disk or it's an internal request.
+func (queue *DiskQueue) persist(request *Request) error {
+
+	if request.disk != nil || request.continuation != nil || strings.HasPrefix(request.Route, "state|") {
+		return nil
+	}
+
+	payload, err := Codecs.EncodeRequest(request)
+	if err != nil {
+		return err
+	}
+	if request.sequence, err = queue.append(payload); err != nil {
+		return err
+	}
+	request.disk = queue
+	return nil
+
+}
+
+// acknowledge marks a request as answered in the disk queue it was written to, if any. This
+// 	is called right before the request's response is stored.
+func (manager *Manager) acknowledge(request *Request) {
+	if request.disk == nil {
+		return
+	}
+	if err := request.disk.ack(request.sequence); err != nil {
+		manager.recordError(request.Route, newRequestError("acknowledge", manager.Name, request, err))
+	}
+	request.disk = nil
+}
+
+// append writes a request to the current segment and returns its sequence number.
+func (queue *DiskQueue) append(payload []byte) (uint64, error) {
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if queue.closed {
+		return 0, ErrQueueClosed
+	}
+	if queue.size >= queue.options.SegmentSize {
+		if err := queue.startSegment(queue.segments[len(queue.segments)-1] + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	queue.sequence++
+	if err := queue.write(diskRecordRequest, queue.sequence, payload); err != nil {
+		return 0, err
+	}
+	segment := queue.segments[len(queue.segments)-1]
+	queue.records[queue.sequence] = segment
+	queue.pending[segment]++
+	return queue.sequence, nil
+
+}
+
+// ack writes an acknowledgement for a request, and removes any segments which are no longer needed.
+func (queue *DiskQueue) ack(sequence uint64) error {
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if queue.closed {
+		return ErrQueueClosed
+	}
+	segment, ok := queue.records[sequence]
+	if !ok {
+		return nil
+	}
+	if err := queue.write(diskRecordAck, sequence, nil); err != nil {
+		return err
+	}
+	delete(queue.records, sequence)
+	queue.pending[segment]--
+	return queue.removeSegments()
+
+}
+
+// isClosed returns whether the queue has been closed.
+func (queue *DiskQueue) isClosed() bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.closed
+}
+
+// write appends a single record to the current segment, flushing it as the sync policy says.
+// 	A record is its kind, sequence number, payload length, payload and a checksum of all of
+// 	them. The lock must already be held.
+func (queue *DiskQueue) write(kind byte, sequence uint64, payload []byte) error {
+
+	record := make([]byte, 1, 1+2*binary.MaxVarintLen64+len(payload)+4)
+	record[0] = kind
+	number := make([]byte, binary.MaxVarintLen64)
+	record = append(record, number[:binary.PutUvarint(number, sequence)]...)
+	record = append(record, number[:binary.PutUvarint(number, uint64(len(payload)))]...)
+	record = append(record, payload...)
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(record))
+	record = append(record, checksum...)
+
+	if _, err := queue.file.Write(record); err != nil {
+		return err
+	}
+	queue.size += int64(len(record))
+
+	now := time.Now()
+	if queue.options.Sync == SyncAlways || (queue.options.Sync == SyncInterval && now.Sub(queue.lastSync) >= queue.options.SyncEvery) {
+		queue.lastSync = now
+		return queue.file.Sync()
+	}
+	return nil
+
+}
+
+// startSegment closes the current segment (if any) and starts writing to a new one. The lock
+// 	must already be held.
+func (queue *DiskQueue) startSegment(segment uint64) error {
+
+	if queue.file != nil {
+		if err := queue.file.Sync(); err != nil {
+			return err
+		}
+		if err := queue.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(queue.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	queue.file, queue.size = file, 0
+	queue.segments = append(queue.segments, segment)
+	return nil
+
+}
+
+// removeSegments deletes the oldest segments for as long as they have no unacknowledged
+// 	requests. Segments are only ever removed oldest first, because an acknowledgement can be
+// 	in a later segment than its request. The segment being written to is never removed. The
+// 	lock must already be held.
+func (queue *DiskQueue) removeSegments() error {
+	for len(queue.segments) > 1 && queue.pending[queue.segments[0]] == 0 {
+		if err := os.Remove(queue.segmentPath(queue.segments[0])); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		delete(queue.pending, queue.segments[0])
+		queue.segments = queue.segments[1:]
+	}
+	return nil
+}
+
+// load reads every segment in the directory, oldest first, keeping the requests which were
+// 	never acknowledged.
+func (queue *DiskQueue) load() error {
+
+	paths, err := filepath.Glob(filepath.Join(queue.directory, "*.segment"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		segment, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".segment"), 10, 64)
+		if err == nil {
+			queue.segments = append(queue.segments, segment)
+		}
+	}
+	sort.Slice(queue.segments, func(i, j int) bool { return queue.segments[i] < queue.segments[j] })
+
+	payloads := map[uint64][]byte{}
+	for _, segment := range queue.segments {
+		if err := queue.readSegment(segment, payloads); err != nil {
+			return err
+		}
+	}
+
+	sequences := make([]uint64, 0, len(queue.records))
+	for sequence, segment := range queue.records {
+		sequences = append(sequences, sequence)
+		queue.pending[segment]++
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	// Decode the requests which were never acknowledged and queue them up again
+	for _, sequence := range sequences {
+		request, err := Codecs.DecodeRequest(payloads[sequence])
+		if err != nil {
+			return fmt.Errorf("request %d: %w", sequence, err)
+		}
+		request.disk, request.sequence = queue, sequence
+		queue.waiting.Enqueue(context.Background(), request)
+	}
+	return nil
+
+}
+
+// readSegment reads the records in a segment, stopping at the first one which is cut short
+// 	or doesn't match its checksum.
+func (queue *DiskQueue) readSegment(segment uint64, payloads map[uint64][]byte) error {
+
+	file, err := os.Open(queue.segmentPath(segment))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	for {
+		kind, sequence, payload, err := readDiskRecord(reader)
+		if err != nil {
+			return nil
+		}
+		if sequence > queue.sequence {
+			queue.sequence = sequence
+		}
+		switch kind {
+		case diskRecordRequest:
+			queue.records[sequence] = segment
+			payloads[sequence] = payload
+		case diskRecordAck:
+			delete(queue.records, sequence)
+			delete(payloads, sequence)
+		}
+	}
+
+}
+
+// readDiskRecord reads a single record written by DiskQueue.write.
+func readDiskRecord(reader *bufio.Reader) (byte, uint64, []byte, error) {
+
+	record := &recordReader{reader: reader}
+	kind, err := record.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	sequence, err := binary.ReadUvarint(record)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, err := binary.ReadUvarint(record)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	payload, err := io.ReadAll(io.LimitReader(record, int64(length)))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if uint64(len(payload)) != length {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+
+	checksum := make([]byte, 4)
+	if _, err := io.ReadFull(reader, checksum); err != nil {
+		return 0, 0, nil, err
+	}
+	if binary.BigEndian.Uint32(checksum) != record.checksum {
+		return 0, 0, nil, errors.New("checksum mismatch")
+	}
+	return kind, sequence, payload, nil
+
+}
+
+// recordReader keeps a running checksum of everything read through it
+type recordReader struct {
+	reader   *bufio.Reader
+	checksum uint32
+}
+
+// Read reads into the buffer, adding what was read to the checksum.
+func (record *recordReader) Read(buffer []byte) (int, error) {
+	count, err := record.reader.Read(buffer)
+	record.checksum = crc32.Update(record.checksum, crc32.IEEETable, buffer[:count])
+	return count, err
+}
+
+// ReadByte reads a single byte, adding it to the checksum.
+func (record *recordReader) ReadByte() (byte, error) {
+	value, err := record.reader.ReadByte()
+	if err == nil {
+		record.checksum = crc32.Update(record.checksum, crc32.IEEETable, []byte{value})
+	}
+	return value, err
+}
+
+// segmentPath returns the file a segment is kept in.
+func (queue *DiskQueue) segmentPath(segment uint64) string {
+	return filepath.Join(queue.directory, fmt.Sprintf("%020d.segment", segment))
+}
@@ -0,0 +1,103 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"errors"
+	"strconv"
+)
+
+/////////////////////
+// SENTINEL ERRORS //
+/////////////////////
+
+// Every error returned by the package wraps one of these (or the error returned by an
+// 	attached function), so you can check for them with errors.Is.
+var (
+	// ErrManagerNotFound is returned when no manager exists with the requested name.
+	ErrManagerNotFound = errors.New("manager not found")
+
+	// ErrManagerExists is returned when creating a manager with a name which is taken.
+	ErrManagerExists = errors.New("manager already exists")
+
+	// ErrRouteNotFound is returned when a request doesn't match any attached route.
+	ErrRouteNotFound = errors.New("route not found")
+
+	// ErrManagerRunning is returned when an operation needs the manager to be stopped.
+	ErrManagerRunning = errors.New("manager is running")
+
+	// ErrStopped is returned when an operation needs the manager to be running, and for
+	// 	requests which were still queued when the manager stopped.
+	ErrStopped = errors.New("manager is stopped")
+
+	// ErrPanic is wrapped by the error returned when an attached function panics.
+	ErrPanic = errors.New("panic while processing")
+)
+
+///////////////////
+// MANAGER ERROR //
+///////////////////
+
+// ManagerError is the structured error returned by the package. It records which operation
+// 	failed, on which manager and route, and wraps the underlying error. Use errors.As to
+// 	get at the details and errors.Is to check the underlying error.
+type ManagerError struct {
+
+	// Op is the operation which failed, like "send", "attach" or "process".
+	Op string
+
+	// Manager is the name of the manager involved.
+	Manager string
+
+	// Route is the route involved. It is empty if the operation didn't involve one.
+	Route string
+
+	// RequestID is the id of the request involved. It is empty if the operation didn't
+	// 	involve a request.
+	RequestID string
+
+	// Err is the underlying error. This is either one of the sentinel errors above, or
+	// 	the error returned by an attached function.
+	Err error
+}
+
+// Error describes the failure, for example:
+//
+//	process manager "Example Manager" route "multiply": route not found
+func (err *ManagerError) Error() string {
+	message := err.Op + " manager " + strconv.Quote(err.Manager)
+	if err.Route != "" {
+		message += " route " + strconv.Quote(err.Route)
+	}
+	if err.Err != nil {
+		message += ": " + err.Err.Error()
+	}
+	return message
+}
+
+// Unwrap returns the underlying error so errors.Is and errors.As can see through it.
+func (err *ManagerError) Unwrap() error {
+	return err.Err
+}
+
+// newError is a small helper for building a ManagerError.
+func newError(op string, managerName string, route string, err error) error {
+	return &ManagerError{
+		Op:      op,
+		Manager: managerName,
+		Route:   route,
+		Err:     err,
+	}
+}
+
+// newRequestError is newError for an operation on a request. The route and request id are
+// 	taken from the request.
+func newRequestError(op string, managerName string, request *Request, err error) error {
+	return &ManagerError{
+		Op:        op,
+		Manager:   managerName,
+		Route:     request.Route,
+		RequestID: request.ID(),
+		Err:       err,
+	}
+}
@@ -0,0 +1,89 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"reflect"
+)
+
+/////////////
+// FUTURES //
+/////////////
+
+// Every request doubles as a future for its own response. The response is stored exactly
+// 	once, so Wait can be called any number of times (from any number of goroutines) and
+// 	will always return the same result.
+
+// Done returns a channel which is closed once the request has a response. This makes it
+// 	easy to wait on a request inside of a select statement.
+func (request *Request) Done() <-chan struct{} {
+	return request.done
+}
+
+// OnComplete runs the callback in its own goroutine once the request has a response.
+// 	It returns the request so calls can be chained.
+func (request *Request) OnComplete(callback func(data any, err error)) *Request {
+	go func() {
+		callback(request.Wait())
+	}()
+	return request
+}
+
+// Then returns a new request which completes with the result of running function on this
+// 	request's data. If this request fails, function is skipped and the new request fails
+// 	with the same error. The new request has the same route and a copy of the metadata, but
+// 	is never sent anywhere.
+func (request *Request) Then(function func(data any) (any, error)) *Request {
+
+	next := NewRequest(request.Route, nil)
+	next.Metadata = request.Metadata.Clone()
+	request.OnComplete(func(data any, err error) {
+		if err == nil {
+			data, err = function(data)
+		}
+		next.storeResponse(responseStruct{Data: data, Error: err})
+	})
+	return next
+
+}
+
+// WaitAll waits for every request to have a response. The results are returned in the
+// 	same order as the requests. If any of the requests failed, the error of the first
+// 	one (in the order given) is returned as well.
+func WaitAll(requests ...*Request) ([]any, error) {
+
+	results := make([]any, len(requests))
+	var firstErr error
+	for i, request := range requests {
+		data, err := request.Wait()
+		results[i] = data
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return results, firstErr
+
+}
+
+// WaitAny waits for the first of the requests to have a response and returns its index
+// 	along with its result. If no requests are given, the index is -1.
+func WaitAny(requests ...*Request) (int, any, error) {
+
+	if len(requests) == 0 {
+		return -1, nil, nil
+	}
+
+	// Select on every done channel at once
+	cases := make([]reflect.SelectCase, len(requests))
+	for i, request := range requests {
+		cases[i] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(request.done),
+		}
+	}
+	chosen, _, _ := reflect.Select(cases)
+
+	data, err := requests[chosen].Wait()
+	return chosen, data, err
+
+}
@@ -0,0 +1,305 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"sort"
+	"time"
+)
+
+///////////
+// ROUTE //
+///////////
+
+// routeRecord is the internal record for an attached function. Along with the function itself,
+// 	it keeps the bookkeeping needed to describe the route through Manager.Info(). All of
+// 	the fields are guarded by the owning manager's stateLock.
+type routeRecord struct {
+
+	// The processing function attached to the route
+	function Handler
+
+	// When the route was attached to the manager
+	attachedAt time.Time
+
+	// The compiled pattern if the route has parameters or a wildcard, otherwise nil
+	pattern *routePattern
+
+	// Whatever the route was annotated with when it was attached
+	options routeOptions
+
+	// The route's circuit breaker, if it was attached with one
+	circuit *circuitBreaker
+
+	// Call, error and retry counters for the route, plus the last time it was called
+	calls      uint64
+	errors     uint64
+	retries    uint64
+	lastCalled time.Time
+
+	// Latency statistics for every processed call
+	totalDuration time.Duration
+	minDuration   time.Duration
+	maxDuration   time.Duration
+}
+
+// The number of errors a manager will remember for introspection
+const recentErrorLimit = 16
+
+//////////
+// INFO //
+//////////
+
+// RouteInfo is a point in time description of a single route attached to a manager.
+type RouteInfo struct {
+	Route      string    `json:"route"`
+	Pattern    bool      `json:"pattern"`
+	AttachedAt time.Time `json:"attachedAt"`
+
+	// Permissions needed to call the route, and whether it skips authorization
+	Permissions []string `json:"permissions,omitempty"`
+	Public      bool     `json:"public,omitempty"`
+
+	// Input describes the data the route accepts, if it was attached with a validator
+	Input *Schema `json:"input,omitempty"`
+
+	// The route's circuit breaker, if it was attached with one
+	Circuit *CircuitInfo `json:"circuit,omitempty"`
+
+	// Whether the route changes the state (see Write)
+	Write bool `json:"write,omitempty"`
+
+	// How often the route has been called, failed and retried, and when it was last called
+	Calls      uint64    `json:"calls"`
+	Errors     uint64    `json:"errors"`
+	Retries    uint64    `json:"retries"`
+	LastCalled time.Time `json:"lastCalled"`
+
+	// Processing latency of the route. These only cover time spent inside the
+	// 	attached function, not time spent waiting in the queue.
+	TotalDuration   time.Duration `json:"totalDuration"`
+	MinDuration     time.Duration `json:"minDuration"`
+	MaxDuration     time.Duration `json:"maxDuration"`
+	AverageDuration time.Duration `json:"averageDuration"`
+}
+
+// ErrorRecord is an error a manager ran into while processing a request.
+type ErrorRecord struct {
+	Route string    `json:"route"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// ManagerInfo is a point in time description of a manager. It is safe to hold onto
+// 	and read from any goroutine because nothing in it points back into the manager.
+type ManagerInfo struct {
+	Name    string    `json:"name"`
+	State   Lifecycle `json:"state"`
+	Running bool      `json:"running"`
+
+	// When the manager last started and how long it has been running since then.
+	// 	Uptime is zero if the manager is not running.
+	StartedAt time.Time     `json:"startedAt"`
+	Uptime    time.Duration `json:"uptime"`
+
+	// Number of queued requests and the size of the queue
+	QueueLength   int `json:"queueLength"`
+	QueueCapacity int `json:"queueCapacity"`
+
+	// The route currently being processed and how long it has been processing.
+	// 	CurrentRoute is empty when the manager is idle.
+	CurrentRoute   string        `json:"currentRoute"`
+	CurrentElapsed time.Duration `json:"currentElapsed"`
+
+	// Retries the manager's retry budget allowed and refused, on both the sending and the
+	// 	manager side
+	Retries        uint64 `json:"retries"`
+	RetriesRefused uint64 `json:"retriesRefused"`
+
+	// Number of requests in the manager's dead letter queue, and in its disk queue waiting
+	// 	to be acknowledged
+	DeadLetters    int `json:"deadLetters"`
+	Unacknowledged int `json:"unacknowledged"`
+
+	// The circuit breaker around the whole manager, if it has one
+	Circuit *CircuitInfo `json:"circuit,omitempty"`
+
+	// The version of the state (see Manager.Version), and of the latest published snapshot
+	// 	of it (see Publish)
+	Version         uint64 `json:"version"`
+	SnapshotVersion uint64 `json:"snapshotVersion"`
+
+	// Every attached route, sorted by route name
+	Routes []RouteInfo `json:"routes"`
+
+	// The most recent processing errors, oldest first
+	RecentErrors []ErrorRecord `json:"recentErrors"`
+}
+
+// Info returns a snapshot of the manager's routes, queue and lifecycle. This does not go
+// 	through the request queue, so it will respond even if the manager is busy (or wedged)
+// 	processing a long request.
+func (manager *Manager) Info() ManagerInfo {
+
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+
+	now := time.Now()
+	info := ManagerInfo{
+		Name:          manager.Name,
+		State:         manager.lifecycle,
+		Running:       manager.lifecycle.active(),
+		StartedAt:     manager.startedAt,
+		QueueLength:   manager.queue.Len(),
+		QueueCapacity: manager.queue.Cap(),
+		Routes:        make([]RouteInfo, 0, len(manager.routes)),
+		RecentErrors:  append([]ErrorRecord{}, manager.recentErrors...),
+
+		Retries:        manager.retries,
+		RetriesRefused: manager.retriesRefused,
+
+		Version:         manager.version,
+		SnapshotVersion: manager.Read().Version,
+	}
+	if manager.deadLetters != nil {
+		info.DeadLetters = manager.deadLetters.Len()
+	}
+	if disk, ok := manager.queue.(*DiskQueue); ok {
+		info.Unacknowledged = disk.Unacknowledged()
+	} else if manager.disk != nil {
+		info.Unacknowledged = manager.disk.Unacknowledged()
+	}
+	if manager.circuit != nil {
+		info.Circuit = manager.circuit.info(now)
+	}
+	if info.Running {
+		info.Uptime = now.Sub(manager.startedAt)
+	}
+	if manager.current != nil {
+		info.CurrentRoute = manager.current.Route
+		info.CurrentElapsed = now.Sub(manager.currentStart)
+	}
+
+	// Copy out every route so the caller can't touch the live records
+	for name, attached := range manager.routes {
+		routeInfo := RouteInfo{
+			Route:         name,
+			Pattern:       attached.pattern != nil,
+			AttachedAt:    attached.attachedAt,
+			Permissions:   append([]string(nil), attached.options.permissions...),
+			Public:        attached.options.public,
+			Write:         attached.options.write,
+			Calls:         attached.calls,
+			Errors:        attached.errors,
+			Retries:       attached.retries,
+			LastCalled:    attached.lastCalled,
+			TotalDuration: attached.totalDuration,
+			MinDuration:   attached.minDuration,
+			MaxDuration:   attached.maxDuration,
+		}
+		if attached.options.input != nil {
+			routeInfo.Input = attached.options.input.Schema()
+		}
+		if attached.circuit != nil {
+			routeInfo.Circuit = attached.circuit.info(now)
+		}
+		if attached.calls > 0 {
+			routeInfo.AverageDuration = attached.totalDuration / time.Duration(attached.calls)
+		}
+		info.Routes = append(info.Routes, routeInfo)
+	}
+	sort.Slice(info.Routes, func(i, j int) bool {
+		return info.Routes[i].Route < info.Routes[j].Route
+	})
+
+	return info
+
+}
+
+// List returns the info for every manager in the DefaultRegistry, sorted by manager name.
+func List() []ManagerInfo {
+	return DefaultRegistry.List()
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// beginRequest marks a request as in flight so that Info() can report on it.
+func (manager *Manager) beginRequest(request *Request) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.current = request
+	manager.currentStart = time.Now()
+}
+
+// endRequest clears the in flight request and updates the statistics for the route which
+// 	handled it. If the request went to the not found handler, there are no statistics to
+// 	update, but the error is still remembered. Postponed is set when the route returned a
+// 	Deferred, whose outcome the circuit breakers only hear about once it's delivered.
+func (manager *Manager) endRequest(request *Request, attached *routeRecord, err error, postponed bool) {
+
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(manager.currentStart)
+	manager.current = nil
+
+	if err != nil {
+		manager.recordErrorLocked(request.Route, err, now)
+	}
+
+	// Circuit breakers only hear about calls which reached a route, and a continuation
+	// 	finishes the call it continues. See circuit.go.
+	if attached != nil {
+		request.pending = &circuitPending{
+			breakers: []*circuitBreaker{manager.circuit, attached.circuit},
+			started:  manager.currentStart,
+		}
+	}
+	if request.pending == nil && postponed {
+		manager.releaseTrialsLocked(request)
+	} else if request.pending != nil && !postponed {
+		manager.recordOutcomeLocked(request, err, now)
+	}
+
+	if attached == nil {
+		return
+	}
+	attached.calls++
+	attached.lastCalled = now
+	if err != nil {
+		attached.errors++
+	}
+
+	// Update the latency statistics
+	attached.totalDuration += elapsed
+	if attached.calls == 1 || elapsed < attached.minDuration {
+		attached.minDuration = elapsed
+	}
+	if elapsed > attached.maxDuration {
+		attached.maxDuration = elapsed
+	}
+
+}
+
+// recordError remembers an error which didn't come from an attached function, such
+// 	as a request for a route which doesn't exist.
+func (manager *Manager) recordError(route string, err error) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.recordErrorLocked(route, err, time.Now())
+}
+
+// recordErrorLocked adds an error to the recent errors, dropping the oldest one once
+// 	the limit is reached. The stateLock must already be held.
+func (manager *Manager) recordErrorLocked(route string, err error, now time.Time) {
+	manager.recentErrors = append(manager.recentErrors, ErrorRecord{
+		Route: route,
+		Error: err.Error(),
+		Time:  now,
+	})
+	if len(manager.recentErrors) > recentErrorLimit {
+		manager.recentErrors = manager.recentErrors[len(manager.recentErrors)-recentErrorLimit:]
+	}
+}
@@ -0,0 +1,410 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+///////////////
+// LIFECYCLE //
+///////////////
+
+// Lifecycle is the state a manager is in. A manager starts out as created, moves through
+// 	starting into running once Start is called, drains while it finishes the requests
+// 	ahead of a kill request, and ends up either stopped or failed. A stopped or failed
+// 	manager can be started again.
+type Lifecycle int
+
+const (
+	// LifecycleCreated is a manager which has never been started
+	LifecycleCreated Lifecycle = iota
+
+	// LifecycleStarting is a manager which is running its OnStart hooks
+	LifecycleStarting
+
+	// LifecycleRunning is a manager which is processing requests
+	LifecycleRunning
+
+	// LifecycleDraining is a manager which has been killed, but is still processing
+	// 	the requests that were queued ahead of the kill
+	LifecycleDraining
+
+	// LifecycleStopped is a manager whose processing loop has exited normally
+	LifecycleStopped
+
+	// LifecycleFailed is a manager whose processing loop exited because an OnStart
+	// 	hook failed or an attached function panicked
+	LifecycleFailed
+)
+
+// String returns the name of the lifecycle state.
+func (lifecycle Lifecycle) String() string {
+	switch lifecycle {
+	case LifecycleCreated:
+		return "created"
+	case LifecycleStarting:
+		return "starting"
+	case LifecycleRunning:
+		return "running"
+	case LifecycleDraining:
+		return "draining"
+	case LifecycleStopped:
+		return "stopped"
+	case LifecycleFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// MarshalText lets the lifecycle show up by name in JSON output (like the debug endpoint).
+func (lifecycle Lifecycle) MarshalText() ([]byte, error) {
+	return []byte(lifecycle.String()), nil
+}
+
+// UnmarshalText is the inverse of MarshalText so that manager info can be read back in.
+func (lifecycle *Lifecycle) UnmarshalText(text []byte) error {
+	for candidate := LifecycleCreated; candidate <= LifecycleFailed; candidate++ {
+		if candidate.String() == string(text) {
+			*lifecycle = candidate
+			return nil
+		}
+	}
+	return errors.New("Unknown manager lifecycle " + string(text) + ".")
+}
+
+// active is true for every state where a processing loop exists
+func (lifecycle Lifecycle) active() bool {
+	return lifecycle == LifecycleStarting || lifecycle == LifecycleRunning || lifecycle == LifecycleDraining
+}
+
+///////////
+// HOOKS //
+///////////
+
+// lifecycleHooks holds every hook attached to a manager. The hooks are all run inside
+// 	the processing goroutine, so they are free to read and modify the manager state.
+type lifecycleHooks struct {
+	start []func(managerState any) error
+	stop  []func(managerState any)
+	error []func(managerState any, request *Request, err error)
+}
+
+// OnStart adds a hook which runs inside the processing goroutine before any requests are
+// 	processed. If the hook returns an error, the manager fails to start and Start returns
+// 	that error.
+func (manager *Manager) OnStart(hook func(managerState any) error) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.hooks.start = append(manager.hooks.start, hook)
+}
+
+// OnStop adds a hook which runs inside the processing goroutine when the manager is killed.
+// 	It runs after every request ahead of the kill has been processed.
+func (manager *Manager) OnStop(hook func(managerState any)) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.hooks.stop = append(manager.hooks.stop, hook)
+}
+
+// OnError adds a hook which runs inside the processing goroutine whenever processing a
+// 	request fails. The request is nil if the error didn't come from a request (like a
+// 	failing OnStart hook).
+func (manager *Manager) OnError(hook func(managerState any, request *Request, err error)) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.hooks.error = append(manager.hooks.error, hook)
+}
+
+/////////////
+// RESTART //
+/////////////
+
+// RestartOptions controls how manager.RestartWith() swaps in a new state.
+type RestartOptions struct {
+
+	// State is the state the manager will use after the restart.
+	State any
+
+	// Transform, if set, builds the new state from the old one instead of using State.
+	// 	It runs inside the processing goroutine, after the stop hooks.
+	Transform func(managerState any) any
+
+	// Drain will process every request queued ahead of the restart with the old state.
+	// 	Otherwise the restart skips ahead of the queue.
+	Drain bool
+}
+
+/////////////
+// WAITING //
+/////////////
+
+// State returns where the manager currently is in its lifecycle.
+func (manager *Manager) State() Lifecycle {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	return manager.lifecycle
+}
+
+// Done returns a channel which is closed when the current (or most recent) call to Start
+// 	returns. If the manager hasn't been started yet, the channel is for the first run.
+func (manager *Manager) Done() <-chan struct{} {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	return manager.done
+}
+
+// WaitUntilRunning blocks until the manager is processing requests. Use this after
+// 	"go manager.Start(state)" instead of sleeping. It returns the context's error if the
+// 	context ends first, and an error if the manager failed to start.
+func (manager *Manager) WaitUntilRunning(ctx context.Context) error {
+
+	for {
+
+		// Check the current state and grab the channel which will tell us it changed
+		manager.stateLock.Lock()
+		lifecycle, changed := manager.lifecycle, manager.lifecycleChanged
+		manager.stateLock.Unlock()
+
+		switch lifecycle {
+		case LifecycleRunning:
+			return nil
+		case LifecycleFailed:
+			return newError("wait", manager.Name, "", ErrStopped)
+		}
+
+		// Otherwise wait for something to happen
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+
+	}
+
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// setLifecycle moves the manager to a new state and wakes everyone waiting on a change.
+func (manager *Manager) setLifecycle(lifecycle Lifecycle) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.setLifecycleLocked(lifecycle)
+}
+
+// setLifecycleLocked is setLifecycle for when the stateLock is already held.
+func (manager *Manager) setLifecycleLocked(lifecycle Lifecycle) {
+	manager.lifecycle = lifecycle
+	close(manager.lifecycleChanged)
+	manager.lifecycleChanged = make(chan struct{})
+}
+
+// beginRun claims the manager for a new processing loop. A fresh done channel is made
+// 	if the previous run already closed its own.
+func (manager *Manager) beginRun() error {
+
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+
+	if manager.lifecycle.active() {
+		return newError("start", manager.Name, "", ErrManagerRunning)
+	}
+
+	if manager.lifecycle != LifecycleCreated {
+		manager.done = make(chan struct{})
+	}
+
+	// A control request which came in as the last run was stopping was already told
+	// 	the manager stopped, so it mustn't be picked up by this run.
+	for len(manager.control) > 0 {
+		request := <-manager.control
+		request.storeResponse(responseStruct{Error: newRequestError("process", manager.Name, request, ErrStopped)})
+	}
+	manager.startedAt = time.Now()
+	manager.runContext, manager.runCancel = context.WithCancel(context.Background())
+	manager.setLifecycleLocked(LifecycleStarting)
+	return nil
+
+}
+
+// endRun is called when Start returns. Anything short of a clean stop is a failure.
+func (manager *Manager) endRun() {
+
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+
+	manager.current = nil
+	if manager.lifecycle.active() {
+		manager.setLifecycleLocked(LifecycleFailed)
+	}
+	close(manager.done)
+
+}
+
+// drain marks a running manager as draining ahead of a kill request.
+func (manager *Manager) drain() {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	if manager.lifecycle == LifecycleRunning {
+		manager.setLifecycleLocked(LifecycleDraining)
+	}
+}
+
+// The number of control requests which can be waiting for the processing loop
+const controlBufferSize = 16
+
+// nextRequest waits for the next request to process. Control requests always win over
+// 	whatever is queued. The only error returned is ErrQueueClosed.
+func (manager *Manager) nextRequest() (*Request, error) {
+
+	for {
+
+		select {
+		case request := <-manager.control:
+			return request, nil
+		default:
+		}
+
+		// Wait on the queue until a control request interrupts it. The control channel
+		// 	is checked again once the interrupt is in place, in case a control request
+		// 	came in before it was.
+		ctx, cancel := context.WithCancel(context.Background())
+		manager.stateLock.Lock()
+		manager.interrupt = cancel
+		if len(manager.control) > 0 {
+			cancel()
+		}
+		manager.stateLock.Unlock()
+
+		request, err := manager.queue.Dequeue(ctx)
+
+		manager.stateLock.Lock()
+		manager.interrupt = nil
+		manager.stateLock.Unlock()
+		cancel()
+
+		if err == nil {
+			return request, nil
+		}
+		if errors.Is(err, ErrQueueClosed) {
+			return nil, err
+		}
+
+	}
+
+}
+
+// interruptQueue stops the processing loop waiting on the queue, so it picks up the
+// 	control request which was just sent.
+func (manager *Manager) interruptQueue() {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	if manager.interrupt != nil {
+		manager.interrupt()
+	}
+}
+
+// restart runs the stop hooks on the old state, builds the new state and runs the start
+// 	hooks on it. This is always called from inside the processing loop.
+func (manager *Manager) restart(managerState any, options RestartOptions) (any, error) {
+
+	manager.setLifecycle(LifecycleStarting)
+	for _, hook := range manager.stopHooks() {
+		hook(managerState)
+	}
+
+	newState := options.State
+	if options.Transform != nil {
+		newState = options.Transform(managerState)
+	}
+
+	for _, hook := range manager.startHooks() {
+		if err := hook(newState); err != nil {
+			err = newError("restart", manager.Name, "", err)
+			manager.runErrorHooks(newState, nil, err)
+			return nil, err
+		}
+	}
+
+	manager.stateLock.Lock()
+	manager.startedAt = time.Now()
+	manager.setLifecycleLocked(LifecycleRunning)
+	manager.stateLock.Unlock()
+	return newState, nil
+
+}
+
+// rejectQueued answers everything left in the queue (and any control requests) once the
+// 	processing loop has stopped. Requests on disk are left unacknowledged, so they are
+// 	delivered again the next time their disk queue is opened (see DiskQueue).
+func (manager *Manager) rejectQueued() {
+
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for {
+		var request *Request
+		select {
+		case request = <-manager.control:
+		default:
+			var err error
+			if request, err = manager.queue.Dequeue(stopped); err != nil {
+				return
+			}
+		}
+
+		err := newRequestError("process", manager.Name, request, ErrStopped)
+		manager.deadLetter(request, DeadLetterRejected, err)
+		manager.releaseTrials(request)
+		request.disk = nil
+		request.storeResponse(responseStruct{Error: err})
+	}
+
+}
+
+// currentRequest returns the request which is currently being processed, if any.
+func (manager *Manager) currentRequest() *Request {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	return manager.current
+}
+
+// startHooks returns a copy of the start hooks so they can run without the lock held.
+func (manager *Manager) startHooks() []func(managerState any) error {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	return append([]func(managerState any) error{}, manager.hooks.start...)
+}
+
+// stopHooks returns a copy of the stop hooks so they can run without the lock held.
+func (manager *Manager) stopHooks() []func(managerState any) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	return append([]func(managerState any){}, manager.hooks.stop...)
+}
+
+// runErrorHooks runs every error hook against a failure.
+func (manager *Manager) runErrorHooks(managerState any, request *Request, err error) {
+
+	manager.stateLock.Lock()
+	hooks := append([]func(managerState any, request *Request, err error){}, manager.hooks.error...)
+	manager.stateLock.Unlock()
+
+	for _, hook := range hooks {
+		hook(managerState, request, err)
+	}
+
+}
+
+// reportFailure runs everything a failed request goes through before it's answered: the
+// 	error hooks, the log and the dead letter queue.
+func (manager *Manager) reportFailure(managerState any, request *Request, err error) {
+	manager.runErrorHooks(managerState, request, err)
+	manager.logError(request, err)
+	manager.deadLetter(request, DeadLetterError, err)
+}
@@ -3,9 +3,11 @@
 package managers
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 ///////////////////////////
@@ -15,7 +17,7 @@ import (
 // Internal managers struct used for public requests. This data is just
 // 	for storing a link from a manager name to the manager. The main use case
 // 	for this is to allow managers to be created and used without tracking the
-//  the handle to the manager.
+//  the handle to the manager. These back the DefaultRegistry (see registry.go).
 var managersMap = make(map[string]*Manager)
 var managersLock = sync.Mutex{}
 
@@ -34,14 +36,6 @@ func getManager(managerName string) (*Manager, bool) {
 
 }
 
-// deleteManager is an internal function for deleting a manager from the managersMap.
-// 	This function uses the managersLock to ensure thread safety.
-func deleteManager(managerName string) {
-	managersLock.Lock()
-	defer managersLock.Unlock()
-	delete(managersMap, managerName)
-}
-
 /////////////
 // MANAGER //
 /////////////
@@ -55,16 +49,81 @@ type Manager struct {
 	// 	to handle.
 	Name string
 
-	// Requests is a channel used to keep track of everything the manager has
-	// 	been asked to do.
-	requests chan *Request
+	// Queue keeps track of everything the manager has been asked to do (see queue.go).
+	// 	Control is used for internal requests which need to skip ahead of the queue (like
+	// 	a restart which doesn't drain), and interrupt cancels the wait on the queue so the
+	// 	loop can pick them up.
+	queue     Queue
+	control   chan *Request
+	interrupt context.CancelFunc
+
+	// Where the manager is in its lifecycle. See lifecycle.go for the states and the
+	// 	hooks which run as the manager moves between them.
+	lifecycle Lifecycle
+	hooks     lifecycleHooks
+
+	// lifecycleChanged is closed (and replaced) every time the lifecycle changes and
+	// 	done is closed when the current (or most recent) call to Start returns.
+	lifecycleChanged chan struct{}
+	done             chan struct{}
+
+	// startedAt is the time the manager last started processing.
+	startedAt time.Time
+
+	// current is the request currently being processed (nil when idle) and
+	// 	currentStart is when the manager began processing it.
+	current      *Request
+	currentStart time.Time
+
+	// Routes is a map of request type to respective processing function and its metadata.
+	//	These functions will take in a request interface and respond with a response interface.
+	routes map[string]*routeRecord
+
+	// Patterns are the routes with parameters or wildcards, sorted by precedence. NotFound
+	// 	is the handler used when no route matches (nil for the default error).
+	patterns []*routeRecord
+	notFound Handler
 
-	// Whether or not the manager is currently processing
-	running bool
+	// recentErrors keeps the last few processing errors for introspection.
+	recentErrors []ErrorRecord
 
-	// Functions is a map of request type to respective processing function.
-	//	These functions will take in a request interface and respond with a response interface.
-	functions map[string]func(managerState any, request any) any
+	// Authorizer is consulted before each request is dispatched. See authorization.go.
+	authorizer Authorizer
+
+	// Where failed requests are kept, if anywhere. See deadletter.go.
+	deadLetters *DeadLetterQueue
+
+	// The retry budget, and how many retries it allowed and refused. See retry.go.
+	retryBudget    *retryBudget
+	retries        uint64
+	retriesRefused uint64
+
+	// Retries waiting on their backoff, with the error which caused them, and the ones
+	// 	being queued again. The run context is cancelled when the run stops so retries
+	// 	stop being queued. See retry.go.
+	retrying   map[*Request]error
+	retrySends sync.WaitGroup
+	runContext context.Context
+	runCancel  context.CancelFunc
+
+	// The circuit breaker around the whole manager, if it has one. See circuit.go.
+	circuit *circuitBreaker
+
+	// Where requests are kept until they are answered, if anywhere. See disk.go.
+	disk *DiskQueue
+
+	// The latest published snapshot of the state, the lock publishers take turns with, and
+	// 	the function which copies the state for automatic snapshots. See snapshot.go.
+	snapshot     atomic.Value
+	snapshotLock sync.Mutex
+	snapshotCopy func(managerState any) any
+
+	// The version of the state, bumped by every write route. See versioning.go.
+	version uint64
+
+	// Options are what the manager was created with. They never change afterwards, so
+	// 	they can be read without the lock. See options.go.
+	options managerOptions
 
 	// stateLock determines whether or not values in the Manager can be read or editted.
 	// 	The only exception is the Name, which the "managers" package doesn't care about.
@@ -76,20 +135,74 @@ type Manager struct {
 // 	loop which handles the process. It's very straightforward. Just loop through and process
 // 	each request as they come through until a kill request is sent. This function is blocking
 // 	and you should detach it if you want the manager to function correctly.
-func (manager *Manager) Start(managerState any) {
+//
+// 	Start returns nil once the manager has been killed. It returns an error if the manager
+// 	is already running, if an OnStart hook fails, or if an attached function panics. In the
+// 	last two cases the manager is left in the LifecycleFailed state. However the loop
+// 	ends, requests still in the queue are answered with ErrStopped rather than being left
+// 	for the next run.
+func (manager *Manager) Start(managerState any) (err error) {
+
+	// Claim the manager so that only one processing loop can run at a time.
+	if err := manager.beginRun(); err != nil {
+		return err
+	}
 
-	// Freeze the state so that the manager can be set to running. Then unfreeze so
-	// 	the rest of the data can be read (like the functions)
-	manager.stateLock.Lock()
-	manager.running = true
-	manager.stateLock.Unlock()
+	// If an attached function panics, the manager is marked as failed and whoever was
+	// 	waiting on the request is told about it rather than left hanging.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			request := manager.currentRequest()
+			err = newError("process", manager.Name, "", fmt.Errorf("%w: %v", ErrPanic, recovered))
+			if request != nil {
+				err = newRequestError("process", manager.Name, request, fmt.Errorf("%w: %v", ErrPanic, recovered))
+			}
+			manager.runErrorHooks(managerState, request, err)
+			if request != nil {
+				manager.deadLetter(request, DeadLetterPanic, err)
+				manager.releaseTrials(request)
+				manager.acknowledge(request)
+				request.storeResponse(responseStruct{Error: err})
+			}
+		}
+
+		// However the run ended, nothing it left behind will be picked up by it anymore.
+		// 	Rather than leaving queued requests (and retries still waiting on their backoff)
+		// 	to be mixed into the next run, let the senders know the manager stopped.
+		if manager.IsRunning() {
+			manager.setLifecycle(LifecycleFailed)
+		}
+		manager.stopRetries(managerState)
+		manager.rejectQueued()
+		manager.endRun()
+	}()
+
+	// Run the start hooks before any requests are processed. If any of them fail, the
+	// 	manager never starts processing.
+	for _, hook := range manager.startHooks() {
+		if err := hook(managerState); err != nil {
+			err = newError("start", manager.Name, "", err)
+			manager.runErrorHooks(managerState, nil, err)
+			return err
+		}
+	}
+	manager.setLifecycle(LifecycleRunning)
+	manager.publishState(managerState)
 
 	// Big for loop for the manager to handle incoming requests.
 	for {
 
 		// Wait for a request to come in before parsing it
-		// 	and deciding what to do based on the route.
-		request := <-manager.requests
+		// 	and deciding what to do based on the route. If the queue is closed, there
+		// 	will never be another one, so the manager stops.
+		request, err := manager.nextRequest()
+		if err != nil {
+			for _, hook := range manager.stopHooks() {
+				hook(managerState)
+			}
+			manager.setLifecycle(LifecycleStopped)
+			return newError("process", manager.Name, "", err)
+		}
 
 		// Response object data. Initialize to nil values. The response
 		// 	will be populated with data as the route function is processed.
@@ -97,6 +210,7 @@ func (manager *Manager) Start(managerState any) {
 			Data:  nil,
 			Error: nil,
 		}
+		responded, retried, postponed := false, false, false
 
 		// Internal kill command for the manager. When manager.Kill() is called, it
 		// 	will send this route. This will just store an arbitrary response and then
@@ -105,61 +219,189 @@ func (manager *Manager) Start(managerState any) {
 		// 	strictly enforce it.
 		if request.Route == "state|kill-manager" {
 
-			// Signify the request was processed and then break out of the processing loop.
+			// Run the stop hooks while we still own the state, then signify the request
+			// 	was processed and break out of the processing loop.
+			for _, hook := range manager.stopHooks() {
+				hook(managerState)
+			}
+			manager.setLifecycle(LifecycleStopped)
 			request.storeResponse(response)
 			break
 
+			// Internal restart command for the manager. See manager.Restart() for details.
+		} else if request.Route == "state|restart-manager" {
+
+			// Swap in the new state. If the start hooks fail on the new state, the manager
+			// 	fails just like it would have during Start.
+			newState, err := manager.restart(managerState, request.Data.(RestartOptions))
+			if err != nil {
+				request.storeResponse(responseStruct{Error: err})
+				return err
+			}
+			managerState = newState
+			manager.bumpVersion(1)
+			manager.publishState(managerState)
+			request.storeResponse(response)
+
+			// Internal transaction command. The loop is held by the transaction until the
+			// 	coordinator releases it. See transaction.go for details.
+		} else if request.Route == "state|transaction" {
+
+			manager.holdTransaction(managerState, request.Data.(*participant))
+			request.storeResponse(response)
+
 			// User defined commands will end up here
 		} else {
 
-			// Check to see if that route was added.
-			//	If it wasn't, return an error.
+			// Check to see if that route was added, either exactly or through a pattern.
+			//	If it wasn't, use the not found handler or return an error.
 			//	If it was, process the job .
-			function, ok := manager.getFunction(request.Route)
-			if !ok {
-				response.Error = errors.New("No function named " + request.Route + " added to " + manager.Name + " manager.")
+			//	Requests coming back from a Deferred run their continuation instead of the
+			//	route (see deferred.go). Those were already authorized the first time around.
+			var attached *routeRecord
+			var function Handler
+			var denied, invalid, conflict error
+			var write bool
+			if continuation := request.continuation; continuation != nil {
+				request.continuation = nil
+				function = func(managerState any, request *Request) any {
+					return continuation(managerState)
+				}
+
+				// Continuations of write routes are writes too (see versioning.go)
+				if record, _ := manager.resolve(request.Route); record != nil {
+					write = record.options.write
+				}
+			} else {
+				attached, request.Params = manager.resolve(request.Route)
+				function = manager.getNotFound()
+				if attached != nil {
+					function = attached.function
+				}
+				if function != nil {
+					denied = manager.guard(request, func() error { return manager.authorize(request, attached) })
+				}
+				write = attached != nil && attached.options.write
+				if denied == nil {
+					invalid = manager.guard(request, func() error { return manager.validate(request, attached) })
+				}
+				if denied == nil && invalid == nil {
+					conflict = manager.checkVersion(request)
+				}
+			}
+
+			// Requests whose sender has already given up (see SendContext) are answered
+			// 	with the context's error rather than processed.
+			if err := request.Context().Err(); err != nil {
+				response.Error = newRequestError("process", manager.Name, request, err)
+				manager.recordError(request.Route, response.Error)
+			} else if function == nil {
+				response.Error = newRequestError("process", manager.Name, request, ErrRouteNotFound)
+				manager.recordError(request.Route, response.Error)
+			} else if denied != nil {
+				response.Error = newRequestError("authorize", manager.Name, request, denied)
+				manager.recordError(request.Route, response.Error)
+			} else if invalid != nil {
+				response.Error = newRequestError("validate", manager.Name, request, invalid)
+				manager.recordError(request.Route, response.Error)
+			} else if conflict != nil {
+				response.Error = newRequestError("version", manager.Name, request, conflict)
+				manager.recordError(request.Route, response.Error)
 			} else {
 
 				// If here, it's time to process the job. We simply send the current managerState
 				// 	to the processing function along with the requested data.
-				response.Data = function(managerState, request.Data)
+				published := manager.Read().Version
+				span := manager.startSpans(request)
+				manager.beginRequest(request)
+				started := time.Now()
+				response.Data = manager.invoke(function, managerState, request)
 
 				// If there is an error with the process, set the error appropriately. Also
 				// 	remove the original response data as it was an error.
 				if err, ok := response.Data.(error); ok {
 					response.Data = nil
-					response.Error = err
+					response.Error = newRequestError("process", manager.Name, request, err)
+				}
+
+				// Streams are handed to the caller straight away and then filled from
+				// 	inside the loop. See stream.go for details.
+				if stream, ok := response.Data.(*Stream); ok {
+					request.storeResponse(response)
+					responded = true
+					response.Error = stream.run(manager, request)
+				}
+
+				// Deferred responses are answered later, once the deferred is completed.
+				deferred, _ := response.Data.(*Deferred)
+				if deferred != nil {
+					responded = true
+					postponed = true
+				}
+				manager.endRequest(request, attached, response.Error, postponed)
+				manager.observe(request, started, response.Error)
+				if deferred != nil {
+					deferred.bind(manager, request)
+				}
+
+				// Successful writes move the state on to the next version and publish a
+				// 	snapshot of it. See versioning.go and snapshot.go. Writes which return a
+				// 	Deferred are only finished once their continuation succeeds.
+				if response.Error == nil && write && !postponed {
+					manager.wrote(managerState, published, 1)
+				}
+				span.finish(response.Error)
+
+				// Failures the route's retry policy covers are queued again instead of
+				// 	answered. See retry.go.
+				if response.Error != nil && !responded && manager.retryLater(request, attached, response.Error) {
+					responded = true
+					retried = true
 				}
 			}
 
 			// If there is an error, just let the user know about it. (If they have logging enabled that is.)
-			if response.Error != nil && LOG_PROCESSING_ERRORS {
-				fmt.Println("Error in manager, " + manager.Name + ":")
-				fmt.Println(response.Error)
+			// 	The request is also kept in the dead letter queue if there is one.
+			if response.Error != nil && !retried {
+				manager.reportFailure(managerState, request, response.Error)
+			}
+
+			// Once the request is answered, it no longer needs to be kept on disk. Deferred
+			// 	requests are acknowledged when they are delivered.
+			if !retried && !postponed {
+				manager.acknowledge(request)
+			}
+
+			// Requests which never reached their route hand back any circuit breaker trials
+			// 	they were let through with. Deferred requests keep theirs until they are
+			// 	delivered. See circuit.go.
+			if !postponed {
+				manager.releaseTrials(request)
 			}
 
 			// Add the response to the request. All this does is send the response in the
 			// 	response channel on the request. This allows the "Wait" function on the
 			// 	request to respond appropriately.
-			request.storeResponse(response)
+			if !responded {
+				request.storeResponse(response)
+			}
 
 		}
 
 	}
 
-	// Freeze the state so that the manager can be set to not running
-	manager.stateLock.Lock()
-	manager.running = false
-	manager.stateLock.Unlock()
+	// Anything still queued was sent after the kill, and is answered as the run ends
+	return nil
 
 }
 
-// IsRunning will just return the value of manager.running. Simple binding so that we
-// 	can ensure thread safety of manager attributes.
+// IsRunning will return whether or not the manager has a processing loop. Simple binding
+// 	so that we can ensure thread safety of manager attributes. A manager which is starting
+// 	up or draining is still considered to be running.
 func (manager *Manager) IsRunning() bool {
 	manager.stateLock.Lock()
 	defer manager.stateLock.Unlock()
-	return manager.running
+	return manager.lifecycle.active()
 }
 
 ///////////////////////
@@ -174,7 +416,7 @@ func (manager *Manager) Send(route string, data any) *Request {
 	request := NewRequest(route, data)
 
 	// Send the job to the manager
-	manager.requests <- request
+	manager.SendRequest(request)
 
 	// Respond with the request
 	return request
@@ -185,7 +427,104 @@ func (manager *Manager) Send(route string, data any) *Request {
 // 	that the .requests field can stay hidden and unaccessible to users. However, it can also
 //  be utilized if a user wishes to interact with it in a different way.
 func (manager *Manager) SendRequest(request *Request) {
-	manager.requests <- request
+	manager.sendRequest(request)
+}
+
+// sendRequest is SendRequest, returning the context the request was sent with (including
+// 	the manager's deadline, see WithTimeout). The context is taken before the request is
+// 	queued, since the processing loop may be working on the request straight afterwards.
+func (manager *Manager) sendRequest(request *Request) context.Context {
+
+	manager.applyTimeout(request)
+	ctx := request.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if err := manager.admitRequest(request); err != nil {
+		request.storeResponse(responseStruct{Error: err})
+		return ctx
+	}
+	if err := manager.persist(request); err != nil {
+		manager.releaseTrials(request)
+		request.storeResponse(responseStruct{Error: err})
+		return ctx
+	}
+	request.queuedAt = time.Now()
+	if err := manager.queue.Enqueue(context.Background(), request); err != nil {
+		manager.releaseTrials(request)
+		manager.acknowledge(request)
+		request.storeResponse(responseStruct{Error: newRequestError("send", manager.Name, request, err)})
+	}
+	return ctx
+
+}
+
+// SendContext is Send with a context. The context is carried on the request (see
+// 	request.Context()) along with any trace it belongs to. If the context ends before the
+// 	manager gets to the request, the request is answered with the context's error instead
+// 	of being processed. This blocks while the queue is full, returning the context's error
+// 	if it ends first.
+func (manager *Manager) SendContext(ctx context.Context, route string, data any) (*Request, error) {
+
+	request := NewRequest(route, data)
+	if err := manager.sendContext(ctx, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+
+}
+
+// AwaitContext is Await with a context. See SendContext. It stops waiting once the context
+// 	ends, returning the context's error.
+func (manager *Manager) AwaitContext(ctx context.Context, route string, data any) (any, error) {
+
+	request, err := manager.SendContext(ctx, route, data)
+	if err != nil {
+		return nil, err
+	}
+	return manager.waitContext(ctx, request)
+
+}
+
+// sendContext queues a request carrying the context, giving up if the context ends first.
+func (manager *Manager) sendContext(ctx context.Context, request *Request) error {
+
+	request.ctx = ctx
+	request.contextMetadata(ctx)
+	manager.applyTimeout(request)
+	if err := manager.admitRequest(request); err != nil {
+		return err
+	}
+	if err := manager.persist(request); err != nil {
+		manager.releaseTrials(request)
+		return err
+	}
+	request.queuedAt = time.Now()
+
+	if err := manager.queue.Enqueue(ctx, request); err != nil {
+		manager.releaseTrials(request)
+		manager.acknowledge(request)
+		return newRequestError("send", manager.Name, request, err)
+	}
+	return nil
+
+}
+
+// waitContext waits for a request's response, giving up if the context ends first. A
+// 	response which is already there always wins over the context.
+func (manager *Manager) waitContext(ctx context.Context, request *Request) (any, error) {
+	select {
+	case <-request.Done():
+		return request.Wait()
+	default:
+	}
+	select {
+	case <-request.Done():
+		return request.Wait()
+	case <-ctx.Done():
+		return nil, newRequestError("await", manager.Name, request, ctx.Err())
+	}
 }
 
 // Await will send a job to the manager and await completion. See Request.Await()
@@ -193,18 +532,21 @@ func (manager *Manager) SendRequest(request *Request) {
 func (manager *Manager) Await(route string, data any) (any, error) {
 
 	// Create and send the request to the manager
-	request := manager.Send(route, data)
+	request := NewRequest(route, data)
+	ctx := manager.sendRequest(request)
 
-	// Wait for the request to complete
-	return request.Wait()
+	// Wait for the request to complete, or until its deadline if the manager gives
+	// 	requests one (see WithTimeout)
+	return manager.waitContext(ctx, request)
 
 }
 
 // AwaitRequest will queue a premade request to the manager. This is mainly just to ensure
-// 	that the .requests field can stay hidden.
+// 	that the .requests field can stay hidden. Like Await, it stops waiting at the request's
+// 	deadline if the manager gives requests one (see WithTimeout).
 func (manager *Manager) AwaitRequest(request *Request) (any, error) {
-	manager.SendRequest(request)
-	return request.Wait()
+	ctx := manager.sendRequest(request)
+	return manager.waitContext(ctx, request)
 }
 
 /////////////
@@ -216,22 +558,70 @@ func (manager *Manager) AwaitRequest(request *Request) (any, error) {
 // 	kill without waiting for a success.
 func (manager *Manager) Kill() error {
 
+	// Mark the manager as draining. Everything queued ahead of the kill request will
+	// 	still be processed before the manager stops.
+	manager.drain()
+
 	// Just send a kill request and wait for completion
 	_, err := manager.Await("state|kill-manager", nil)
 	return err
 
 }
 
+// Restart will atomically swap the state of a running manager. The swap happens inside the
+// 	processing loop, so no request ever sees a half swapped state. The stop hooks run against
+// 	the old state and the start hooks run against the new one. Attached routes, statistics
+// 	and queued requests are all kept. Requests queued when Restart is called are processed
+// 	with the new state. Use RestartWith to drain them with the old state instead.
+func (manager *Manager) Restart(newState any) error {
+	return manager.RestartWith(RestartOptions{State: newState})
+}
+
+// RestartWith is Restart with control over draining and how the new state is built.
+// 	See RestartOptions for the details. This is blocking and will wait for the restart.
+func (manager *Manager) RestartWith(options RestartOptions) error {
+
+	// Only a manager which is processing can be restarted. Everything else should just
+	// 	use Start.
+	done := manager.Done()
+	if manager.State() != LifecycleRunning {
+		return newError("restart", manager.Name, "", ErrStopped)
+	}
+
+	// Draining restarts wait their turn in the queue, otherwise skip ahead of it. If the
+	// 	manager stops before it picks up the restart, there is nothing left to restart.
+	request := NewRequest("state|restart-manager", options)
+	if options.Drain {
+		manager.SendRequest(request)
+	} else {
+		select {
+		case manager.control <- request:
+			manager.interruptQueue()
+		case <-done:
+			return newError("restart", manager.Name, "", ErrStopped)
+		}
+	}
+
+	select {
+	case <-request.Done():
+		_, err := request.Wait()
+		return err
+	case <-done:
+		return newError("restart", manager.Name, "", ErrStopped)
+	}
+
+}
+
 // Remove is the function which will remove the manager from the public map.
 // 	Once this is done, the manager should be deleted/removed from memory.
 func (manager *Manager) Remove() error {
 
 	// Can only remove if the manager is not running
 	if manager.IsRunning() {
-		return errors.New("Unable to remove manager " + manager.Name + " because it is currently running.")
+		return newError("remove", manager.Name, "", ErrManagerRunning)
 	}
 
-	deleteManager(manager.Name)
+	manager.options.registry.remove(manager.Name)
 	return nil
 }
 
@@ -239,7 +629,7 @@ func (manager *Manager) Remove() error {
 func (manager *Manager) KillAndRemove() error {
 
 	// Just send a kill request and wait for completion
-	_, err := manager.Await("state|kill-manager", nil)
+	err := manager.Kill()
 	if err != nil {
 		return err
 	}
@@ -254,13 +644,20 @@ func (manager *Manager) KillAndRemove() error {
 ///////////////
 
 // Attach will attach a function to a manager at a specific route. Once a function is
-// 	attached, requests sent to the manager are able to find and use the function.
-func (manager *Manager) Attach(route string, function func(managerState any, request any) any) {
+// 	attached, requests sent to the manager are able to find and use the function. Options
+// 	annotate the route (see RouteOption).
+func (manager *Manager) Attach(route string, function func(managerState any, request any) any, options ...RouteOption) {
+	manager.AttachHandler(route, dataHandler(function), options...)
+}
+
+// AttachHandler is the same as Attach, but the handler receives the whole request
+// 	instead of just its data.
+func (manager *Manager) AttachHandler(route string, handler Handler, options ...RouteOption) {
 
 	// This is simple as just attaching the function
 	manager.stateLock.Lock()
 	defer manager.stateLock.Unlock()
-	manager.functions[route] = function
+	manager.attachLocked(route, handler, options)
 
 }
 
@@ -269,17 +666,24 @@ func (manager *Manager) Attach(route string, function func(managerState any, req
 func (manager *Manager) Detach(route string) {
 	manager.stateLock.Lock()
 	defer manager.stateLock.Unlock()
-	delete(manager.functions, route)
+	delete(manager.routes, route)
+	manager.rebuildPatternsLocked()
 }
 
-// getFunction returns the function of a given name. This is just an internal function
-// 	to handle race conditions.
-func (manager *Manager) getFunction(route string) (func(managerState any, request any) any, bool) {
-
-	// This is simple as just returning the function
-	manager.stateLock.Lock()
-	defer manager.stateLock.Unlock()
-	function, ok := manager.functions[route]
-	return function, ok
-
+// attachLocked attaches a handler while the stateLock is already held. Routes containing
+// 	parameters or a wildcard are compiled into patterns (see pattern.go).
+func (manager *Manager) attachLocked(route string, handler Handler, options []RouteOption) {
+	attached := &routeRecord{
+		function:   handler,
+		attachedAt: time.Now(),
+		pattern:    compilePattern(route),
+	}
+	for _, option := range options {
+		option(&attached.options)
+	}
+	if attached.options.circuit != nil {
+		attached.circuit = newCircuitBreaker(*attached.options.circuit)
+	}
+	manager.routes[route] = attached
+	manager.rebuildPatternsLocked()
 }
@@ -0,0 +1,113 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The metadata keys the package knows about. Any other key can be used for arbitrary headers.
+const (
+	// MetadataRequestID is the unique id given to every request by NewRequest
+	MetadataRequestID = "request-id"
+
+	// MetadataCaller identifies whoever sent the request
+	MetadataCaller = "caller"
+
+	// MetadataTenant is the tenant the request is being made on behalf of
+	MetadataTenant = "tenant"
+
+	// MetadataDeadline is the deadline of the context the request was sent with, in RFC 3339
+	MetadataDeadline = "deadline"
+
+	// MetadataTraceID and MetadataSpanID are the trace the request was sent as part of
+	MetadataTraceID = "trace-id"
+	MetadataSpanID  = "span-id"
+
+	// MetadataPriority is the priority of the request, as a number, for priority queues
+	MetadataPriority = "priority"
+
+	// MetadataExpectedVersion is the version the request expects the manager's state to be
+	// 	at, for conditional requests (see Request.IfVersion)
+	MetadataExpectedVersion = "expected-version"
+)
+
+//////////////
+// METADATA //
+//////////////
+
+// Metadata is a set of string headers carried along with a request. Every request gets a
+// 	unique MetadataRequestID, and requests sent with SendContext get the deadline and trace
+// 	ids of their context. Everything else is up to the sender. Because it's a plain string
+// 	map, metadata survives being encoded and sent anywhere a request can go.
+type Metadata map[string]string
+
+// Get returns the value of a key, or an empty string if it isn't set. It is safe to call
+// 	on nil metadata.
+func (metadata Metadata) Get(key string) string {
+	return metadata[key]
+}
+
+// Set sets the value of a key.
+func (metadata Metadata) Set(key string, value string) {
+	metadata[key] = value
+}
+
+// Clone returns a copy of the metadata which can be changed without affecting the original.
+func (metadata Metadata) Clone() Metadata {
+	clone := make(Metadata, len(metadata))
+	for key, value := range metadata {
+		clone[key] = value
+	}
+	return clone
+}
+
+// ID returns the unique id of the request.
+func (request *Request) ID() string {
+	return request.Metadata.Get(MetadataRequestID)
+}
+
+// WithMetadata sets a metadata key on the request before it is sent. It returns the request
+// 	so calls can be chained:
+//
+//	request := managers.NewRequest("charge", order).WithMetadata(managers.MetadataTenant, "acme")
+func (request *Request) WithMetadata(key string, value string) *Request {
+	if request.Metadata == nil {
+		request.Metadata = Metadata{}
+	}
+	request.Metadata.Set(key, value)
+	return request
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// Request ids are a random prefix for the process followed by a counter, which keeps them
+// 	unique without needing any randomness per request.
+var (
+	requestIDPrefix  = newTraceID(4)
+	requestIDCounter uint64
+)
+
+// newRequestID returns the next unique request id
+func newRequestID() string {
+	return requestIDPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&requestIDCounter, 1), 10)
+}
+
+// contextMetadata fills in the metadata which comes from the context a request is sent with.
+// 	Anything the sender already set is left alone.
+func (request *Request) contextMetadata(ctx context.Context) {
+
+	if deadline, ok := ctx.Deadline(); ok && request.Metadata.Get(MetadataDeadline) == "" {
+		request.WithMetadata(MetadataDeadline, deadline.Format(time.RFC3339Nano))
+	}
+	if span, ok := SpanFromContext(ctx); ok && request.Metadata.Get(MetadataTraceID) == "" {
+		request.WithMetadata(MetadataTraceID, span.TraceID)
+		request.WithMetadata(MetadataSpanID, span.SpanID)
+	}
+
+}
@@ -0,0 +1,217 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultBufferSize is the size of the queue of a manager created with New, unless it's
+// 	given WithBufferSize or WithQueue.
+const DefaultBufferSize = 128
+
+// PanicPolicy is what a manager does when an attached function panics.
+type PanicPolicy int
+
+const (
+	// PanicStop fails the manager. The request is answered with an error wrapping ErrPanic
+	// 	and Start returns the same error. This is the default.
+	PanicStop PanicPolicy = iota
+
+	// PanicRecover answers the request with an error wrapping ErrPanic and carries on
+	// 	processing. The state is whatever the function left it as when it panicked. This
+	// 	covers the authorizer, validators and stream producers as well as attached
+	// 	functions, but not hooks (see OnStart, OnStop and OnError).
+	PanicRecover
+)
+
+// Logger is where a manager logs processing errors. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, args ...any)
+}
+
+// Metrics receives a measurement for every request a manager processes. It's called from
+// 	inside the processing goroutine, so it should return quickly.
+type Metrics interface {
+
+	// RequestProcessed is called once the attached function for a request returns, with
+	// 	how long the request waited in the queue, how long the function took and the error
+	// 	it returned, if any.
+	RequestProcessed(managerName string, route string, waited time.Duration, took time.Duration, err error)
+}
+
+/////////////
+// OPTIONS //
+/////////////
+
+// Option configures a manager as it is created. Options are passed as the last arguments
+// 	to New (or NewManager).
+type Option func(options *managerOptions)
+
+// managerOptions is everything a manager can be configured with when it is created
+type managerOptions struct {
+
+	// The queue requests wait in. Nil means a channel queue of bufferSize.
+	bufferSize int
+	queue      Queue
+
+	// Where processing errors are logged, and whether a logger was given at all (a nil
+	// 	logger turns logging off)
+	logger    Logger
+	loggerSet bool
+
+	timeout  time.Duration
+	hooks    lifecycleHooks
+	registry *Registry
+	panics   PanicPolicy
+	metrics  Metrics
+}
+
+// WithBufferSize sets how many requests the manager's queue holds before sending blocks.
+func WithBufferSize(bufferSize int) Option {
+	return func(options *managerOptions) {
+		options.bufferSize = bufferSize
+	}
+}
+
+// WithQueue sets the queue the manager takes its requests from. The buffer size is ignored.
+func WithQueue(queue Queue) Option {
+	return func(options *managerOptions) {
+		options.queue = queue
+	}
+}
+
+// WithLogger logs the manager's processing errors to the logger instead of printing them
+// 	depending on LOG_PROCESSING_ERRORS. A nil logger turns logging off for the manager.
+func WithLogger(logger Logger) Option {
+	return func(options *managerOptions) {
+		options.logger = logger
+		options.loggerSet = true
+	}
+}
+
+// WithTimeout gives every request sent to the manager a deadline, timeout after it was sent,
+// 	unless it was sent with a context which already has one. A request still queued at its
+// 	deadline is answered with context.DeadlineExceeded instead of processed, and Await stops
+// 	waiting on it. Internal requests (like the ones sent by Kill) never time out.
+func WithTimeout(timeout time.Duration) Option {
+	return func(options *managerOptions) {
+		options.timeout = timeout
+	}
+}
+
+// WithStartHook adds a start hook as the manager is created. See OnStart.
+func WithStartHook(hook func(managerState any) error) Option {
+	return func(options *managerOptions) {
+		options.hooks.start = append(options.hooks.start, hook)
+	}
+}
+
+// WithStopHook adds a stop hook as the manager is created. See OnStop.
+func WithStopHook(hook func(managerState any)) Option {
+	return func(options *managerOptions) {
+		options.hooks.stop = append(options.hooks.stop, hook)
+	}
+}
+
+// WithErrorHook adds an error hook as the manager is created. See OnError.
+func WithErrorHook(hook func(managerState any, request *Request, err error)) Option {
+	return func(options *managerOptions) {
+		options.hooks.error = append(options.hooks.error, hook)
+	}
+}
+
+// WithRegistry adds the manager to the registry instead of the DefaultRegistry.
+func WithRegistry(registry *Registry) Option {
+	return func(options *managerOptions) {
+		options.registry = registry
+	}
+}
+
+// WithPanicPolicy sets what the manager does when an attached function panics.
+func WithPanicPolicy(policy PanicPolicy) Option {
+	return func(options *managerOptions) {
+		options.panics = policy
+	}
+}
+
+// WithMetrics reports every request the manager processes to metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(options *managerOptions) {
+		options.metrics = metrics
+	}
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// invoke runs the function attached to a route. Under PanicRecover, a panic is returned as
+// 	an error instead of taking down the processing loop.
+func (manager *Manager) invoke(function Handler, managerState any, request *Request) (result any) {
+	if manager.options.panics == PanicRecover {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				result = fmt.Errorf("%w: %v", ErrPanic, recovered)
+			}
+		}()
+	}
+	return function(managerState, request)
+}
+
+// guard runs the authorizer or a validator for a request. Under PanicRecover, a panic is
+// 	returned as an error just like it is for the attached function. Otherwise the request
+// 	is marked as in flight before panicking again, so it's answered as the manager fails.
+func (manager *Manager) guard(request *Request, check func() error) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if manager.options.panics != PanicRecover {
+				manager.beginRequest(request)
+				panic(recovered)
+			}
+			err = fmt.Errorf("%w: %v", ErrPanic, recovered)
+		}
+	}()
+	return check()
+}
+
+// logError logs a processing error to the manager's logger, or prints it if the manager
+// 	doesn't have one and LOG_PROCESSING_ERRORS is set.
+func (manager *Manager) logError(request *Request, err error) {
+	if manager.options.loggerSet {
+		if manager.options.logger != nil {
+			manager.options.logger.Printf("Error in manager, %s (request %s): %v", manager.Name, request.ID(), err)
+		}
+	} else if LOG_PROCESSING_ERRORS {
+		fmt.Println("Error in manager, " + manager.Name + " (request " + request.ID() + "):")
+		fmt.Println(err)
+	}
+}
+
+// observe reports a processed request to the manager's metrics, if it has any.
+func (manager *Manager) observe(request *Request, started time.Time, err error) {
+	if manager.options.metrics != nil {
+		manager.options.metrics.RequestProcessed(manager.Name, request.Route, started.Sub(request.queuedAt), time.Since(started), err)
+	}
+}
+
+// applyTimeout gives a request the manager's deadline as it is sent, if it needs one.
+func (manager *Manager) applyTimeout(request *Request) {
+
+	if manager.options.timeout <= 0 || request.cancel != nil || strings.HasPrefix(request.Route, "state|") {
+		return
+	}
+	parent := request.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	if _, ok := parent.Deadline(); ok {
+		return
+	}
+	request.ctx, request.cancel = context.WithTimeout(parent, manager.options.timeout)
+	request.contextMetadata(request.ctx)
+
+}
@@ -3,8 +3,18 @@
 package managers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"log"
 	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -149,8 +159,9 @@ func Test_Manager(t *testing.T) {
 // Test that is complete is working
 func Test_hasData(t *testing.T) {
 	m := createHandledManager(t, "Manager", 256)
-	go m.Start(&State{Status: "Starting Up", Value: 0})
-	<-time.Tick(5 * time.Millisecond)
+	if err := m.WaitUntilRunning(context.Background()); err != nil {
+		t.Fatal(err)
+	}
 	r := m.Send("setStatus", "Status 1")
 	if m.IsRunning() != true {
 		t.Error("Didn't show manager as running")
@@ -164,6 +175,2469 @@ func Test_hasData(t *testing.T) {
 	}
 }
 
+// Test that introspection reports routes, queue and in flight requests
+func Test_Info(t *testing.T) {
+
+	m := createHandledManager(t, "Info Manager", 16)
+	<-time.Tick(5 * time.Millisecond)
+
+	// Block the manager on a slow route so we can see it in flight
+	release := make(chan bool)
+	m.Attach("block", func(any, any) any { <-release; return nil })
+	m.Attach("fail", func(any, any) any { return errors.New("test error") })
+	blocked := m.Send("block", nil)
+	m.Send("setValue", 4)
+	<-time.Tick(5 * time.Millisecond)
+
+	info := m.Info()
+	if !info.Running || info.StartedAt.IsZero() || info.Uptime <= 0 {
+		t.Error("Didn't report manager as running")
+	}
+	if info.CurrentRoute != "block" || info.CurrentElapsed <= 0 {
+		t.Error("Didn't report the in flight route")
+	}
+	if info.QueueLength != 1 || info.QueueCapacity != 16 {
+		t.Error("Didn't report the queue correctly")
+	}
+	if len(info.Routes) != 6 || info.Routes[0].Route != "block" {
+		t.Error("Didn't report routes in sorted order")
+	}
+
+	// Once released, the counters should update and the manager should be idle
+	close(release)
+	blocked.Wait()
+	m.Await("fail", nil)
+	m.Await("fail", nil)
+	info = m.Info()
+	if info.CurrentRoute != "" {
+		t.Error("Didn't clear the in flight route")
+	}
+	for _, route := range info.Routes {
+		if route.Route == "fail" && (route.Calls != 2 || route.Errors != 2 || route.LastCalled.IsZero()) {
+			t.Error("Didn't count route calls and errors")
+		}
+		if route.Route == "block" && (route.MaxDuration < 5*time.Millisecond || route.AverageDuration != route.TotalDuration) {
+			t.Error("Didn't record route latency")
+		}
+	}
+	if len(info.RecentErrors) != 2 || info.RecentErrors[0].Route != "fail" {
+		t.Error("Didn't record recent errors")
+	}
+
+	// The registry listing should include the manager
+	found := false
+	for _, listed := range List() {
+		if listed.Name == "Info Manager" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Didn't list the manager")
+	}
+
+	if err := m.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+	if m.Info().Running {
+		t.Error("Didn't report manager as stopped")
+	}
+
+}
+
+// Test the debug endpoint renders both HTML and JSON
+func Test_DebugHandler(t *testing.T) {
+
+	m := createHandledManager(t, "Debug Manager", 16)
+	<-time.Tick(5 * time.Millisecond)
+	m.Await("setValue", 3)
+
+	handler := DebugHandler()
+
+	// HTML by default
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/managers", nil))
+	if !strings.Contains(recorder.Header().Get("Content-Type"), "text/html") || !strings.Contains(recorder.Body.String(), "Debug Manager") {
+		t.Error("Didn't render HTML")
+	}
+
+	// JSON when asked, filtered to the one manager
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/managers?format=json&manager=Debug+Manager", nil))
+	infos := []ManagerInfo{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "Debug Manager" || len(infos[0].Routes) != 4 {
+		t.Error("Didn't render JSON")
+	}
+
+	if err := m.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+// Test the lifecycle states and hooks of a manager
+func Test_Lifecycle(t *testing.T) {
+
+	m, err := NewManager("Lifecycle Manager", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.State() != LifecycleCreated {
+		t.Error("Didn't show manager as created")
+	}
+
+	// Hooks all run against the manager state
+	stopped := false
+	errored := 0
+	m.OnStart(func(managerState any) error {
+		managerState.(*State).Status = "Started"
+		return nil
+	})
+	m.OnStop(func(managerState any) { stopped = true })
+	m.OnError(func(managerState any, request *Request, err error) { errored++ })
+	m.Attach("get", getTestState)
+	release := make(chan bool)
+	m.Attach("block", func(any, any) any { <-release; return nil })
+
+	go m.Start(&State{Status: "Starting Up", Value: 0})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.WaitUntilRunning(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(nil); err == nil {
+		t.Error("Didn't refuse to start twice")
+	}
+	if response, _ := m.Await("get", nil); response.(*State).Status != "Started" {
+		t.Error("Didn't run the start hook")
+	}
+	m.Await("missing", nil)
+
+	// While the kill waits behind a blocked request, the manager is draining
+	m.Send("block", nil)
+	go m.Kill()
+	<-time.Tick(5 * time.Millisecond)
+	if m.State() != LifecycleDraining {
+		t.Error("Didn't show manager as draining")
+	}
+	close(release)
+	<-m.Done()
+	if m.State() != LifecycleStopped || !stopped || errored != 1 {
+		t.Error("Didn't stop cleanly")
+	}
+
+	// A failing start hook leaves the manager failed, and rejects whatever was queued
+	m.OnStart(func(any) error { return errors.New("test error") })
+	queued := m.Send("get", nil)
+	if err := m.Start(&State{}); err == nil || m.State() != LifecycleFailed {
+		t.Error("Didn't fail to start")
+	}
+	if _, err := queued.Wait(); !errors.Is(err, ErrStopped) {
+		t.Error("Didn't reject the request queued before the failed start:", err)
+	}
+	if err := m.WaitUntilRunning(context.Background()); err == nil {
+		t.Error("Didn't report the failed start")
+	}
+	if err := m.Remove(); err != nil {
+		t.Fail()
+	}
+
+	// A panicking function fails the manager and answers the request with an error
+	p, _ := NewManager("Panic Manager", 16)
+	p.Attach("panic", func(any, any) any { panic("test panic") })
+	go p.Start(nil)
+	if _, err := p.Await("panic", nil); err == nil {
+		t.Error("Didn't return the panic as an error")
+	}
+	<-p.Done()
+	if p.State() != LifecycleFailed {
+		t.Error("Didn't show manager as failed")
+	}
+
+	// Requests queued behind the panic are rejected instead of leaking into the next run
+	p.Attach("get", getTestState)
+	panicked := p.Send("panic", nil)
+	queued = p.Send("get", nil)
+	go p.Start(&State{})
+	if _, err := panicked.Wait(); !errors.Is(err, ErrPanic) {
+		t.Error("Didn't return the panic as an error:", err)
+	}
+	<-p.Done()
+	if _, err := queued.Wait(); !errors.Is(err, ErrStopped) {
+		t.Error("Didn't reject the request queued behind the panic:", err)
+	}
+	if err := p.Remove(); err != nil {
+		t.Fail()
+	}
+
+	// Panics in validators and the authorizer are handled like panics in the route
+	for _, policy := range []PanicPolicy{PanicRecover, PanicStop} {
+		guarded, err := New("Guarded Manager", WithPanicPolicy(policy), WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		guarded.Attach("get", getTestState)
+		guarded.Attach("checked", getTestState, Input(testPanicker{}))
+		go guarded.Start(&State{})
+		guarded.WaitUntilRunning(context.Background())
+
+		request := guarded.Send("checked", nil)
+		select {
+		case <-request.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Left the request waiting on a panicking validator")
+		}
+		if _, err := request.Wait(); !errors.Is(err, ErrPanic) {
+			t.Error("Didn't return the validator's panic as an error:", err)
+		}
+		if policy == PanicStop {
+			<-guarded.Done()
+			if state := guarded.State(); state != LifecycleFailed {
+				t.Error("Didn't fail the manager:", state)
+			}
+			guarded.Remove()
+			continue
+		}
+
+		guarded.SetAuthorizer(testPanicker{})
+		if _, err := guarded.Await("get", nil); !errors.Is(err, ErrPanic) || !guarded.IsRunning() {
+			t.Error("Didn't recover from the authorizer's panic:", err)
+		}
+		guarded.SetAuthorizer(nil)
+		if _, err := guarded.Await("get", nil); err != nil {
+			t.Error("Didn't carry on after the panics:", err)
+		}
+		guarded.KillAndRemove()
+	}
+
+}
+
+// Test that managers can be killed and started again, and restarted in place
+func Test_Restart(t *testing.T) {
+
+	m := createHandledManager(t, "Restart Manager", 16)
+	if err := m.WaitUntilRunning(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan bool)
+	m.Attach("block", func(any, any) any { <-release; return nil })
+
+	// Requests queued behind a kill are rejected instead of leaking into the next run
+	m.Send("block", nil)
+	go m.Kill()
+	<-time.Tick(5 * time.Millisecond)
+	late := m.Send("setValue", 7)
+	release <- true
+	if _, err := late.Wait(); err == nil {
+		t.Error("Didn't reject the request queued behind the kill")
+	}
+	<-m.Done()
+
+	// Kill and Start cycles keep the routes and statistics
+	for cycle := 0; cycle < 3; cycle++ {
+		go m.Start(&State{Value: cycle})
+		if err := m.WaitUntilRunning(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if square, _ := m.Await("square", nil); square.(int) != cycle*cycle {
+			t.Error("Didn't use the new state after starting again")
+		}
+		if err := m.Kill(); err != nil {
+			t.Fatal(err)
+		}
+		<-m.Done()
+	}
+	for _, route := range m.Info().Routes {
+		if route.Route == "square" && route.Calls != 3 {
+			t.Error("Didn't keep route statistics across restarts")
+		}
+	}
+	if err := m.Restart(&State{}); err == nil {
+		t.Error("Didn't refuse to restart a stopped manager")
+	}
+
+	// A restart which doesn't drain skips ahead of the queued requests
+	go m.Start(&State{Value: 1})
+	m.WaitUntilRunning(context.Background())
+	m.Send("block", nil)
+	m.Send("setValue", 5)
+	restarted := make(chan error)
+	go func() { restarted <- m.Restart(&State{Value: 2}) }()
+	<-time.Tick(5 * time.Millisecond)
+	release <- true
+	if err := <-restarted; err != nil {
+		t.Fatal(err)
+	}
+	if square, _ := m.Await("square", nil); square.(int) != 25 {
+		t.Error("Didn't restart ahead of the queue")
+	}
+
+	// A draining restart processes the queued requests with the old state first
+	m.Send("block", nil)
+	m.Send("setValue", 5)
+	go func() {
+		restarted <- m.RestartWith(RestartOptions{
+			Drain:     true,
+			Transform: func(managerState any) any { return &State{Value: managerState.(*State).Value + 1} },
+		})
+	}()
+	<-time.Tick(5 * time.Millisecond)
+	release <- true
+	if err := <-restarted; err != nil {
+		t.Fatal(err)
+	}
+	if square, _ := m.Await("square", nil); square.(int) != 36 {
+		t.Error("Didn't drain before restarting")
+	}
+
+	// A failed restart rejects the queued requests instead of leaving them for the next run
+	m.OnStart(func(managerState any) error {
+		if managerState.(*State).Value < 0 {
+			return errors.New("test error")
+		}
+		return nil
+	})
+	m.Send("block", nil)
+	late = m.Send("setValue", 5)
+	go func() { restarted <- m.Restart(&State{Value: -1}) }()
+	<-time.Tick(5 * time.Millisecond)
+	release <- true
+	if err := <-restarted; err == nil {
+		t.Error("Didn't fail the restart")
+	}
+	<-m.Done()
+	if _, err := late.Wait(); !errors.Is(err, ErrStopped) {
+		t.Error("Didn't reject the request queued behind the failed restart:", err)
+	}
+	go m.Start(&State{Value: 3})
+	m.WaitUntilRunning(context.Background())
+	if square, _ := m.Await("square", nil); square.(int) != 9 {
+		t.Error("Processed a stale request in the next run:", square)
+	}
+
+	if err := m.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+// Test route groups, middleware and mounted routers
+func Test_Groups(t *testing.T) {
+
+	m := createHandledManager(t, "Group Manager", 16)
+
+	// Middleware which records the order it ran in
+	calls := []string{}
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(managerState any, request *Request) any {
+				calls = append(calls, name)
+				return next(managerState, request)
+			}
+		}
+	}
+
+	// Nested groups share their prefix and middleware
+	user := m.Group("user", tag("user"))
+	user.Attach("get", getTestState)
+	user.Group("admin", tag("admin")).Attach("square", getTestSquare)
+	if _, err := m.Await("user.get", nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := m.Await("user.admin.square", nil); err != nil {
+		t.Error(err)
+	}
+	if strings.Join(calls, ",") != "user,user,admin" {
+		t.Error("Didn't run group middleware in order:", calls)
+	}
+
+	// A router can be mounted on more than one manager, and nested inside other routers
+	router := NewRouter(tag("router")).AttachHandler("route", func(managerState any, request *Request) any {
+		return request.Route
+	})
+	outer := NewRouter(tag("outer")).Mount("inner", router)
+	if err := Mount("Group Manager", "order", outer); err != nil {
+		t.Error(err)
+	}
+	user.Mount("shared", router)
+	calls = []string{}
+	if route, _ := m.Await("order.inner.route", nil); route != "order.inner.route" {
+		t.Error("Didn't mount the nested router")
+	}
+	if route, _ := m.Await("user.shared.route", nil); route != "user.shared.route" {
+		t.Error("Didn't mount the router in the group")
+	}
+	if strings.Join(calls, ",") != "outer,router,user,router" {
+		t.Error("Didn't run router middleware in order:", calls)
+	}
+
+	// Detaching a group removes everything inside of it and nothing else
+	user.DetachAll()
+	if _, err := m.Await("user.admin.square", nil); err == nil {
+		t.Error("Didn't detach the nested group")
+	}
+	if _, err := m.Await("order.inner.route", nil); err != nil {
+		t.Error("Detached a route outside the group")
+	}
+	if len(m.Info().Routes) != 5 {
+		t.Error("Didn't detach exactly the group")
+	}
+
+	if err := m.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+// Test pattern routes, their precedence and the not found handler
+func Test_Patterns(t *testing.T) {
+
+	m := createHandledManager(t, "Pattern Manager", 16)
+
+	// Each handler just reports which pattern it was and what it pulled out
+	describe := func(name string) Handler {
+		return func(managerState any, request *Request) any {
+			return name + ":" + request.Param("id") + ":" + request.Param(WildcardParam)
+		}
+	}
+	m.AttachHandler("account/{id}/balance", describe("balance"))
+	m.AttachHandler("account/{id}/{field}", describe("field"))
+	m.AttachHandler("account/main/balance", describe("main"))
+	m.AttachHandler("account/*", describe("account"))
+	m.AttachHandler("*", describe("fallback"))
+
+	expected := map[string]string{
+		"account/42/balance":   "balance:42:",
+		"account/42/owner":     "field:42:",
+		"account/main/balance": "main::",
+		"account/42/a/b":       "account::42/a/b",
+		"order/1":              "fallback::order/1",
+	}
+	for route, want := range expected {
+		if got, err := m.Await(route, nil); err != nil || got != want {
+			t.Error("Route", route, "went to", got, "instead of", want)
+		}
+	}
+
+	// Exact routes still win over the fallback
+	if _, err := m.Await("setValue", 3); err != nil {
+		t.Error(err)
+	}
+
+	// Without the fallback, the not found handler takes over
+	m.Detach("*")
+	if _, err := m.Await("order/1", nil); err == nil {
+		t.Error("Didn't error on a missing route")
+	}
+	m.NotFound(func(managerState any, request *Request) any { return "missing " + request.Route })
+	if got, _ := m.Await("order/1", nil); got != "missing order/1" {
+		t.Error("Didn't use the not found handler")
+	}
+
+	// Pattern statistics are kept on the pattern
+	for _, route := range m.Info().Routes {
+		if route.Route == "account/{id}/balance" && (!route.Pattern || route.Calls != 1) {
+			t.Error("Didn't record the pattern route")
+		}
+	}
+
+	if err := m.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+// Test that errors can be matched with errors.Is and errors.As
+func Test_Errors(t *testing.T) {
+
+	// Missing managers
+	_, err := Await("This Manager Doesn't Exist", "get", nil)
+	managerErr := &ManagerError{}
+	if !errors.Is(err, ErrManagerNotFound) || !errors.As(err, &managerErr) {
+		t.Fatal("Didn't return a missing manager error:", err)
+	}
+	if managerErr.Op != "await" || managerErr.Manager != "This Manager Doesn't Exist" || managerErr.Route != "get" {
+		t.Error("Didn't fill in the error details:", managerErr)
+	}
+
+	// Duplicate managers, missing routes and handler errors
+	m := createHandledManager(t, "Error Manager", 16)
+	if _, err := NewManager("Error Manager", 16); !errors.Is(err, ErrManagerExists) {
+		t.Error("Didn't return a duplicate manager error:", err)
+	}
+	if _, err := m.Await("missing", nil); !errors.Is(err, ErrRouteNotFound) {
+		t.Error("Didn't return a missing route error:", err)
+	}
+	original := errors.New("test error")
+	m.Attach("fail", func(any, any) any { return original })
+	_, err = m.Await("fail", nil)
+	if !errors.Is(err, original) || !errors.As(err, &managerErr) || managerErr.Route != "fail" || managerErr.Op != "process" {
+		t.Error("Didn't wrap the handler error with the route:", err)
+	}
+	if err.Error() != `process manager "Error Manager" route "fail": test error` {
+		t.Error("Didn't describe the error:", err)
+	}
+
+	// Lifecycle errors
+	if err := m.Remove(); !errors.Is(err, ErrManagerRunning) {
+		t.Error("Didn't return a running manager error:", err)
+	}
+	if err := m.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Restart(nil); !errors.Is(err, ErrStopped) {
+		t.Error("Didn't return a stopped manager error:", err)
+	}
+	if err := m.Remove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+// Test streaming responses, including cancellation and errors
+func Test_Stream(t *testing.T) {
+
+	m := createHandledManager(t, "Stream Manager", 16)
+
+	// Streams count up from the state value to the requested number
+	produced := 0
+	m.Attach("count", func(managerState any, request any) any {
+		state := managerState.(*State)
+		return NewStream(0, func(send func(item any) error) error {
+			for i := state.Value; i < request.(int); i++ {
+				if err := send(i); err != nil {
+					return err
+				}
+				produced++
+			}
+			if request.(int) < 0 {
+				return errors.New("test error")
+			}
+			return nil
+		})
+	})
+
+	// Read a whole stream through the iterator
+	stream, err := m.Send("count", 100).Stream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := 0
+	for item, ok := stream.Next(); ok; item, ok = stream.Next() {
+		sum += item.(int)
+	}
+	if sum != 4950 || stream.Err() != nil {
+		t.Error("Didn't stream every item")
+	}
+
+	// Cancelling stops the producer and frees the manager
+	produced = 0
+	stream, _ = m.Send("count", 100).Stream()
+	received := 0
+	for range stream.Items() {
+		received++
+		if received == 3 {
+			stream.Cancel()
+			break
+		}
+	}
+	if _, err := m.Await("setValue", 1); err != nil || produced > 4 {
+		t.Error("Didn't stop the producer after cancelling")
+	}
+
+	// Streams whose caller gives up stop the producer as well
+	expiring, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.AwaitContext(expiring, "count", 100); err != nil {
+		t.Error(err)
+	}
+	<-expiring.Done()
+	if _, err := m.Await("setValue", 1); err != nil || m.Info().CurrentRoute != "" {
+		t.Error("Didn't stop the producer once the context expired:", err)
+	}
+
+	// Errors from the producer are reported once the stream finishes
+	stream, _ = m.Send("count", -1).Stream()
+	for range stream.Items() {
+	}
+	if stream.Err() == nil || !strings.Contains(stream.Err().Error(), "test error") {
+		t.Error("Didn't report the stream error")
+	}
+
+	// Plain values come back as a single item
+	stream, _ = m.Send("square", nil).Stream()
+	if item, ok := stream.Next(); !ok || item.(int) != 1 {
+		t.Error("Didn't wrap the plain value")
+	}
+	if _, ok := stream.Next(); ok {
+		t.Error("Didn't finish the plain value stream")
+	}
+
+	if err := m.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+	// A panicking producer still finishes the stream, and the manager follows its panic policy
+	for _, policy := range []PanicPolicy{PanicRecover, PanicStop} {
+		panicking, err := New("Panicking Stream Manager", WithPanicPolicy(policy), WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		panicking.Attach("get", getTestState)
+		panicking.Attach("explode", func(managerState any, request any) any {
+			return NewStream(0, func(send func(item any) error) error {
+				send(1)
+				panic("test panic")
+			})
+		})
+		go panicking.Start(&State{})
+		stream, err := panicking.Send("explode", nil).Stream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := 0
+		for range stream.Items() {
+			received++
+		}
+		if received != 1 || !errors.Is(stream.Err(), ErrPanic) {
+			t.Error("Didn't finish the panicking stream:", received, stream.Err())
+		}
+		if policy == PanicRecover {
+			if _, err := panicking.Await("get", nil); err != nil {
+				t.Error("Didn't recover from the panic:", err)
+			}
+			panicking.KillAndRemove()
+		} else {
+			<-panicking.Done()
+			if state := panicking.State(); state != LifecycleFailed {
+				t.Error("Didn't fail the manager:", state)
+			}
+			panicking.Remove()
+		}
+	}
+
+}
+
+// Test deferred completion frees the manager and can continue inside it
+func Test_Deferred(t *testing.T) {
+
+	m := createHandledManager(t, "Deferred Manager", 16)
+
+	// "fetch" pretends to do I/O and then stores the result in the state
+	release := make(chan int)
+	m.Attach("fetch", func(managerState any, request any) any {
+		deferred := NewDeferred()
+		go func() {
+			value := <-release
+			deferred.Continue(func(managerState any) any {
+				managerState.(*State).Value = value
+				return value * 2
+			})
+		}()
+		return deferred
+	})
+
+	// The manager keeps processing while the fetch is outstanding
+	fetch := m.Send("fetch", nil)
+	if _, err := m.Await("setStatus", "Fetching"); err != nil {
+		t.Error(err)
+	}
+	if fetch.HasData() {
+		t.Error("Didn't wait for the deferred")
+	}
+	release <- 21
+	if response, err := fetch.Wait(); err != nil || response.(int) != 42 {
+		t.Error("Didn't respond with the continuation result")
+	}
+	if square, _ := m.Await("square", nil); square.(int) != 441 {
+		t.Error("Didn't run the continuation against the state")
+	}
+
+	// Completing before the function returns, failing, and only the first completion counts
+	m.Attach("now", func(managerState any, request any) any {
+		deferred := NewDeferred()
+		deferred.Complete(request)
+		deferred.Fail(errors.New("ignored"))
+		return deferred
+	})
+	if response, err := m.Await("now", "done"); err != nil || response != "done" {
+		t.Error("Didn't respond with the early completion")
+	}
+	if _, err := m.Await("now", errors.New("test error")); err == nil {
+		t.Error("Didn't respond with the failure")
+	}
+
+	if err := m.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+// Test the future helpers on requests
+func Test_Futures(t *testing.T) {
+
+	m1 := createHandledManager(t, "Future Manager 1", 16)
+	m2 := createHandledManager(t, "Future Manager 2", 16)
+	release := make(chan bool)
+	m2.Attach("block", func(any, any) any { <-release; return "released" })
+
+	// Wait can be called as many times as you like
+	m1.Await("setValue", 3)
+	request := m1.Send("square", nil)
+	for i := 0; i < 3; i++ {
+		if square, err := request.Wait(); err != nil || square.(int) != 9 {
+			t.Error("Didn't return the same result on every wait")
+		}
+	}
+
+	// Done works inside a select
+	blocked := m2.Send("block", nil)
+	select {
+	case <-blocked.Done():
+		t.Error("Didn't wait for the blocked request")
+	case <-request.Done():
+	}
+
+	// WaitAny returns whichever finishes first, across managers
+	if index, square, err := WaitAny(blocked, m1.Send("square", nil)); index != 1 || err != nil || square.(int) != 9 {
+		t.Error("Didn't return the first finished request")
+	}
+
+	// Then and OnComplete run once the request finishes
+	completed := make(chan any)
+	chained := blocked.Then(func(data any) (any, error) {
+		return data.(string) + " twice", nil
+	})
+	blocked.OnComplete(func(data any, err error) { completed <- data })
+	failed := m1.Send("missing", nil).Then(func(data any) (any, error) {
+		t.Error("Ran Then on a failed request")
+		return nil, nil
+	})
+	close(release)
+	if <-completed != "released" {
+		t.Error("Didn't run the completion callback")
+	}
+
+	// WaitAll returns everything in order, along with the first error
+	results, err := WaitAll(chained, blocked, failed)
+	if results[0] != "released twice" || results[1] != "released" || !errors.Is(err, ErrRouteNotFound) {
+		t.Error("Didn't wait for all of the requests:", results, err)
+	}
+
+	if err := m1.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+	if err := m2.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+// Test transactions across managers commit, abort, roll back and time out
+func Test_Transaction(t *testing.T) {
+
+	a := createHandledManager(t, "Warehouse A", 16)
+	b := createHandledManager(t, "Warehouse B", 16)
+	a.Await("setValue", 10)
+
+	// Stock is kept in the state value
+	for _, m := range []*Manager{a, b} {
+		m.Attach("reserve", func(managerState any, request any) any {
+			if managerState.(*State).Value < request.(int) {
+				return errors.New("not enough stock")
+			}
+			return nil
+		})
+		m.Attach("accept", func(managerState any, request any) any { return nil })
+		m.Attach("remove", func(managerState any, request any) any {
+			managerState.(*State).Value -= request.(int)
+			return managerState.(*State).Value
+		})
+		m.Attach("add", func(managerState any, request any) any {
+			managerState.(*State).Value += request.(int)
+			return managerState.(*State).Value
+		})
+		m.Attach("aborted", func(managerState any, request any) any {
+			managerState.(*State).Status = "Aborted"
+			return nil
+		})
+	}
+	move := func(amount int, commit string) *Transaction {
+		return NewTransaction(time.Second).
+			Add(TransactionStep{Manager: b, Prepare: "accept", Commit: commit, Rollback: "remove", Abort: "aborted", Data: amount}).
+			Add(TransactionStep{Manager: a, Prepare: "reserve", Commit: "remove", Rollback: "add", Abort: "aborted", Data: amount})
+	}
+	stock := func() (int, int) {
+		sa, _ := a.Await("get", nil)
+		sb, _ := b.Await("get", nil)
+		return sa.(*State).Value, sb.(*State).Value
+	}
+
+	// A successful move commits on both, with results in the order the steps were added
+	results, err := move(4, "add").Execute()
+	if err != nil || results[0].(int) != 4 || results[1].(int) != 6 {
+		t.Error("Didn't commit the transaction:", results, err)
+	}
+
+	// A failed prepare aborts everyone who prepared
+	if _, err := move(50, "add").Execute(); !errors.Is(err, ErrTransactionAborted) {
+		t.Error("Didn't abort on a failed prepare:", err)
+	}
+
+	// A failed commit rolls back everyone who committed
+	b.Attach("explode", func(any, any) any { return errors.New("test error") })
+	if _, err := move(2, "explode").Execute(); !errors.Is(err, ErrTransactionAborted) || !strings.Contains(err.Error(), "test error") {
+		t.Error("Didn't abort on a failed commit:", err)
+	}
+	if sa, sb := stock(); sa != 6 || sb != 4 {
+		t.Error("Didn't leave the stock alone after aborting:", sa, sb)
+	}
+
+	// Nothing else runs on a held manager until the transaction is over
+	release := make(chan bool)
+	b.Attach("slow", func(any, any) any { <-release; return nil })
+	done := make(chan error)
+	go func() {
+		_, err := NewTransaction(time.Second).
+			Add(TransactionStep{Manager: a, Prepare: "reserve", Commit: "remove", Data: 1}).
+			Add(TransactionStep{Manager: b, Prepare: "slow", Commit: "add", Data: 1}).
+			Execute()
+		done <- err
+	}()
+	<-time.Tick(5 * time.Millisecond)
+	during := a.Send("get", nil)
+	<-time.Tick(5 * time.Millisecond)
+	if during.HasData() {
+		t.Error("Didn't hold the manager during the transaction")
+	}
+	release <- true
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if state, _ := during.Wait(); state.(*State).Value != 5 {
+		t.Error("Saw the state part way through the transaction")
+	}
+
+	// Timing out while a manager is busy aborts the managers already held
+	go b.Send("slow", nil)
+	<-time.Tick(5 * time.Millisecond)
+	_, err = NewTransaction(20*time.Millisecond).
+		Add(TransactionStep{Manager: a, Prepare: "reserve", Commit: "remove", Abort: "aborted", Data: 1}).
+		Add(TransactionStep{Manager: b, Prepare: "accept", Commit: "add", Data: 1}).
+		Execute()
+	if !errors.Is(err, ErrTransactionTimeout) {
+		t.Error("Didn't time out:", err)
+	}
+	release <- true
+	if state, _ := a.Await("get", nil); state.(*State).Status != "Aborted" || state.(*State).Value != 5 {
+		t.Error("Didn't abort after the timeout")
+	}
+
+	// A panicking prepare aborts straight away instead of waiting for the deadline. Under
+	// 	PanicRecover the manager carries on afterwards.
+	for _, policy := range []PanicPolicy{PanicRecover, PanicStop} {
+		panicking, err := New("Panicking Warehouse "+strconv.Itoa(int(policy)), WithPanicPolicy(policy), WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		panicking.Attach("get", getTestState)
+		panicking.Attach("explode", func(any, any) any { panic("test panic") })
+		go panicking.Start(&State{})
+		panicking.WaitUntilRunning(context.Background())
+
+		started := time.Now()
+		_, err = NewTransaction(time.Minute).
+			Add(TransactionStep{Manager: a, Prepare: "reserve", Commit: "remove", Data: 1}).
+			Add(TransactionStep{Manager: panicking, Prepare: "explode"}).
+			Execute()
+		if !errors.Is(err, ErrTransactionAborted) || time.Since(started) > time.Second {
+			t.Error("Didn't abort on a panicking prepare:", err)
+		}
+		if policy == PanicRecover {
+			if _, err := panicking.Await("get", nil); err != nil {
+				t.Error("Didn't recover from the panic:", err)
+			}
+			panicking.KillAndRemove()
+		} else {
+			for panicking.IsRunning() {
+				<-time.After(time.Millisecond)
+			}
+			if state := panicking.Info().State; state != LifecycleFailed {
+				t.Error("Didn't fail the manager:", state)
+			}
+			panicking.Remove()
+		}
+	}
+
+	if err := a.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+	if err := b.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+func Test_Workflow(t *testing.T) {
+
+	orders := createHandledManager(t, "Orders", 16)
+	shipping := createHandledManager(t, "Shipping", 16)
+	orders.WaitUntilRunning(context.Background())
+	shipping.WaitUntilRunning(context.Background())
+
+	// Amounts come back from the file store as float64
+	amount := func(data any) int {
+		switch data := data.(type) {
+		case int:
+			return data
+		case float64:
+			return int(data)
+		}
+		return 0
+	}
+	for _, m := range []*Manager{orders, shipping} {
+		m.Attach("add", func(managerState any, request any) any {
+			managerState.(*State).Value += amount(request)
+			return request
+		})
+		m.Attach("remove", func(managerState any, request any) any {
+			managerState.(*State).Value -= amount(request)
+			return request
+		})
+	}
+	shipping.Attach("explode", func(any, any) any { return errors.New("test error") })
+
+	store, err := NewFileWorkflowStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewWorkflowEngine(store)
+	engine.Register(Workflow{Name: "order", Steps: []WorkflowStep{
+		{Name: "charge", Manager: "Orders", Route: "add", Compensate: "remove"},
+		{Name: "ship", Manager: "Shipping", Route: "add", Compensate: "remove"},
+	}})
+	engine.Register(Workflow{Name: "broken", Steps: []WorkflowStep{
+		{Name: "charge", Manager: "Orders", Route: "add", Compensate: "remove"},
+		{Name: "ship", Manager: "Shipping", Route: "explode"},
+	}})
+	values := func() (int, int) {
+		so, _ := orders.Await("get", nil)
+		ss, _ := shipping.Await("get", nil)
+		return so.(*State).Value, ss.(*State).Value
+	}
+
+	// A run which succeeds goes through every step
+	run, err := engine.Run("order", "first", 5)
+	if err != nil || run.Status != WorkflowCompleted || len(run.Results) != 2 {
+		t.Error("Didn't complete the workflow:", run, err)
+	}
+	if so, ss := values(); so != 5 || ss != 5 {
+		t.Error("Didn't run the steps:", so, ss)
+	}
+
+	// Run ids are never reused
+	if _, err := engine.Run("order", "first", 5); !errors.Is(err, ErrWorkflowExists) {
+		t.Error("Ran a workflow twice under one id:", err)
+	}
+	if so, ss := values(); so != 5 || ss != 5 {
+		t.Error("Ran the steps again:", so, ss)
+	}
+	if run, _ := engine.Status("first"); run.Status != WorkflowCompleted {
+		t.Error("Overwrote the existing run:", run)
+	}
+
+	// A failing step compensates the steps before it
+	run, err = engine.Run("broken", "second", 3)
+	if !errors.Is(err, ErrWorkflowFailed) || run.Status != WorkflowCompensated || !strings.Contains(run.Error, "test error") {
+		t.Error("Didn't compensate the workflow:", run, err)
+	}
+	if so, _ := values(); so != 5 {
+		t.Error("Didn't undo the first step:", so)
+	}
+
+	// A run which was cut short is picked up by a new engine
+	store.Save(WorkflowRun{ID: "third", Workflow: "order", Status: WorkflowRunning, Step: 1, Input: 2, Results: []any{2}})
+	restarted := NewWorkflowEngine(store)
+	restarted.Register(Workflow{Name: "order", Steps: []WorkflowStep{
+		{Name: "charge", Manager: "Orders", Route: "add", Compensate: "remove"},
+		{Name: "ship", Manager: "Shipping", Route: "add", Compensate: "remove"},
+	}})
+	resumed, err := restarted.ResumeAll()
+	if err != nil || len(resumed) != 1 || resumed[0].ID != "third" {
+		t.Error("Didn't resume the unfinished run:", resumed, err)
+	}
+	if so, ss := values(); so != 5 || ss != 7 {
+		t.Error("Didn't resume from the saved step:", so, ss)
+	}
+	if run, err := restarted.Status("third"); err != nil || run.Status != WorkflowCompleted {
+		t.Error("Didn't save the resumed run:", run, err)
+	}
+	if _, err := restarted.Status("missing"); !errors.Is(err, ErrWorkflowNotFound) {
+		t.Error("Found a run which doesn't exist:", err)
+	}
+	if runs, _ := restarted.List(); len(runs) != 3 {
+		t.Error("Didn't list every run:", runs)
+	}
+
+	// The error from the failed step can still be matched
+	engine.Register(Workflow{Name: "missing", Steps: []WorkflowStep{
+		{Name: "charge", Manager: "Orders", Route: "nowhere"},
+	}})
+	if _, err := engine.Run("missing", "fourth", 1); !errors.Is(err, ErrWorkflowFailed) || !errors.Is(err, ErrRouteNotFound) {
+		t.Error("Didn't keep the step error:", err)
+	}
+
+	// Run ids can't reach outside the store's directory
+	for _, id := range []string{"../escaped", "nested/run", `nested\run`, ".."} {
+		if _, err := engine.Run("order", id, 1); !errors.Is(err, ErrInvalidWorkflowID) {
+			t.Error("Accepted an invalid run id:", id, err)
+		}
+	}
+
+	if err := orders.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+	if err := shipping.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+func Test_Tracing(t *testing.T) {
+
+	exporter := NewInMemoryExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+
+	front := createHandledManager(t, "Front", 16)
+	back := createHandledManager(t, "Back", 16)
+	front.AttachHandler("forward", func(managerState any, request *Request) any {
+		data, err := back.AwaitContext(request.Context(), "square", request.Data)
+		if err != nil {
+			return err
+		}
+		return data
+	})
+	back.Attach("fail", func(any, any) any { return errors.New("test error") })
+	back.Await("setValue", 7)
+
+	// A request sent with a span is traced through both managers
+	root := SpanContext{TraceID: strings.Repeat("ab", 16), SpanID: strings.Repeat("cd", 8)}
+	ctx := ContextWithSpan(context.Background(), root)
+	if data, err := front.AwaitContext(ctx, "forward", nil); err != nil || data.(int) != 49 {
+		t.Error("Didn't forward the request:", data, err)
+	}
+	if _, err := back.AwaitContext(ctx, "fail", nil); err == nil {
+		t.Error("Didn't return the route's error")
+	}
+
+	spans := map[string]Span{}
+	for _, span := range exporter.Spans() {
+		if span.TraceID == root.TraceID {
+			spans[span.Attributes["manager.name"]+" "+span.Name] = span
+		}
+	}
+	if len(spans) != 6 {
+		t.Fatal("Didn't record a queue and process span for every request:", spans)
+	}
+	process := spans["Front process forward"]
+	if process.ParentSpanID != root.SpanID || spans["Front queue forward"].ParentSpanID != root.SpanID {
+		t.Error("Didn't parent the first manager's spans to the caller")
+	}
+	if spans["Back process square"].ParentSpanID != process.SpanID || spans["Back queue square"].ParentSpanID != process.SpanID {
+		t.Error("Didn't carry the trace through to the second manager")
+	}
+	if process.Duration() < spans["Back process square"].Duration() || process.Attributes["manager.route"] != "forward" {
+		t.Error("Didn't time the process span:", process)
+	}
+	if !strings.Contains(spans["Back process fail"].Error, "test error") {
+		t.Error("Didn't record the error on the span")
+	}
+
+	// Requests whose context has ended are rejected instead of processed
+	release := make(chan bool)
+	front.Attach("slow", func(any, any) any { <-release; return nil })
+	front.Send("slow", nil)
+	cancelled, cancel := context.WithCancel(context.Background())
+	request, _ := front.SendContext(cancelled, "setValue", 100)
+	timeout, stop := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if _, err := front.AwaitContext(timeout, "get", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Didn't stop waiting when the context ended:", err)
+	}
+	stop()
+	cancel()
+	release <- true
+	if _, err := request.Wait(); !errors.Is(err, context.Canceled) {
+		t.Error("Processed a cancelled request:", err)
+	}
+	if state, _ := front.Await("get", nil); state.(*State).Value == 100 {
+		t.Error("Ran the cancelled request")
+	}
+
+	// The file exporter writes one OTLP request per line
+	path := t.TempDir() + "/traces.json"
+	file, err := NewOTLPFileExporter(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Export(spans["Back process fail"])
+	file.Close()
+	contents, _ := os.ReadFile(path)
+	decoded := map[string]any{}
+	if err := json.Unmarshal(contents, &decoded); err != nil || !strings.Contains(string(contents), `"traceId":"`+root.TraceID+`"`) || !strings.Contains(string(contents), `"code":2`) {
+		t.Error("Didn't write the span in OTLP JSON:", string(contents), err)
+	}
+
+	if err := front.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+	if err := back.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+func Test_Metadata(t *testing.T) {
+
+	manager := createHandledManager(t, "Metadata Manager", 16)
+
+	// Middleware and handlers can both see the metadata
+	group := manager.Group("tenant", func(next Handler) Handler {
+		return func(managerState any, request *Request) any {
+			if request.Metadata.Get(MetadataTenant) == "" {
+				return errors.New("no tenant")
+			}
+			return next(managerState, request)
+		}
+	})
+	group.AttachHandler("whoami", func(managerState any, request *Request) any {
+		return request.Metadata.Get(MetadataTenant) + " " + request.Metadata.Get("x-custom")
+	})
+
+	// Every request gets a unique id
+	first, second := NewRequest("get", nil), NewRequest("get", nil)
+	if first.ID() == "" || first.ID() == second.ID() {
+		t.Error("Didn't give requests unique ids:", first.ID(), second.ID())
+	}
+
+	request := NewRequest("tenant.whoami", nil).WithMetadata(MetadataTenant, "acme").WithMetadata("x-custom", "value")
+	if data, err := manager.AwaitRequest(request); err != nil || data.(string) != "acme value" {
+		t.Error("Didn't pass the metadata to the handler:", data, err)
+	}
+
+	// Errors carry the id of the request which failed
+	failed := manager.Send("tenant.whoami", nil)
+	_, err := failed.Wait()
+	managerError := &ManagerError{}
+	if !errors.As(err, &managerError) || managerError.RequestID != failed.ID() {
+		t.Error("Didn't put the request id on the error:", err)
+	}
+
+	// Sending with a context fills in the deadline and trace
+	root := SpanContext{TraceID: strings.Repeat("12", 16), SpanID: strings.Repeat("34", 8)}
+	ctx, cancel := context.WithTimeout(ContextWithSpan(context.Background(), root), time.Minute)
+	defer cancel()
+	sent, _ := manager.SendContext(ctx, "get", nil)
+	sent.Wait()
+	if sent.Metadata.Get(MetadataTraceID) != root.TraceID || sent.Metadata.Get(MetadataSpanID) != root.SpanID {
+		t.Error("Didn't copy the trace into the metadata:", sent.Metadata)
+	}
+	if deadline, err := time.Parse(time.RFC3339Nano, sent.Metadata.Get(MetadataDeadline)); err != nil || time.Until(deadline) <= 0 {
+		t.Error("Didn't copy the deadline into the metadata:", sent.Metadata)
+	}
+
+	// Derived futures keep the metadata
+	next := request.Then(func(data any) (any, error) { return data, nil })
+	if next.ID() != request.ID() || next.Metadata.Get(MetadataTenant) != "acme" {
+		t.Error("Didn't copy the metadata to the derived request:", next.Metadata)
+	}
+	next.Metadata.Set(MetadataTenant, "other")
+	if request.Metadata.Get(MetadataTenant) != "acme" {
+		t.Error("Shared the metadata with the derived request")
+	}
+
+	if err := manager.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+func Test_Authorization(t *testing.T) {
+
+	manager := createHandledManager(t, "Authorization Manager", 16)
+	manager.Attach("orders.create", func(any, any) any { return "created" })
+	manager.Attach("orders.refund", func(any, any) any { return "refunded" }, Permissions("refunds"))
+	manager.Attach("health", func(any, any) any { return "ok" }, Public())
+	manager.SetAuthorizer(NewRolePolicy().
+		Grant("admin", "*").
+		Grant("clerk", "orders.*", "get").
+		Assign("alice", "admin").
+		Assign("bob", "clerk"))
+
+	call := func(caller string, route string) error {
+		_, err := manager.AwaitRequest(NewRequest(route, nil).WithMetadata(MetadataCaller, caller))
+		return err
+	}
+
+	// Roles grant routes directly or through prefixes
+	if err := call("bob", "orders.create"); err != nil {
+		t.Error("Refused an allowed route:", err)
+	}
+	if err := call("bob", "square"); !errors.Is(err, ErrForbidden) {
+		t.Error("Allowed a route the caller has no permission for:", err)
+	}
+
+	// Routes annotated with permissions need those permissions instead of the route
+	if err := call("bob", "orders.refund"); !errors.Is(err, ErrForbidden) {
+		t.Error("Allowed a route without its permission:", err)
+	}
+	if err := call("alice", "orders.refund"); err != nil {
+		t.Error("Refused an admin:", err)
+	}
+
+	// Public routes skip the authorizer, and unknown callers are refused everything else
+	if err := call("", "health"); err != nil {
+		t.Error("Refused a public route:", err)
+	}
+	if err := call("", "get"); !errors.Is(err, ErrForbidden) {
+		t.Error("Allowed a request without a caller:", err)
+	}
+	managerError := &ManagerError{}
+	if err := call("mallory", "get"); !errors.As(err, &managerError) || managerError.Op != "authorize" {
+		t.Error("Didn't describe the refusal:", err)
+	}
+
+	// The annotations are visible through Info
+	for _, route := range manager.Info().Routes {
+		if route.Route == "orders.refund" && (len(route.Permissions) != 1 || route.Permissions[0] != "refunds") {
+			t.Error("Didn't expose the route's permissions:", route)
+		}
+		if route.Route == "health" && !route.Public {
+			t.Error("Didn't expose the public route:", route)
+		}
+	}
+
+	// Without an authorizer everything is allowed again
+	manager.SetAuthorizer(nil)
+	if err := call("", "square"); err != nil {
+		t.Error("Refused a request without an authorizer:", err)
+	}
+
+	if err := manager.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+type testOrder struct {
+	Item     string   `json:"item" validate:"required"`
+	Quantity int      `json:"quantity" validate:"min=1,max=100"`
+	Speed    string   `json:"speed" validate:"oneof=standard express"`
+	Notes    []string `json:"notes,omitempty" validate:"max=2"`
+	internal int
+}
+
+type testNode struct {
+	Value    int         `json:"value"`
+	Next     *testNode   `json:"next"`
+	Children []*testNode `json:"children"`
+}
+
+func Test_Validation(t *testing.T) {
+
+	manager := createHandledManager(t, "Validation Manager", 16)
+	manager.Attach("order", func(managerState any, request any) any {
+		return request.(testOrder).Quantity
+	}, Input(TypeOf(testOrder{})))
+	manager.Attach("person", func(managerState any, request any) any { return "ok" }, Input(&Schema{
+		Type:     "object",
+		Required: []string{"name", "age"},
+		Properties: map[string]*Schema{
+			"name": {Type: "string", MinLength: Int(1)},
+			"age":  {Type: "integer", Minimum: Float(0)},
+			"tags": {Type: "array", Items: &Schema{Type: "string", Enum: []any{"a", "b"}}},
+		},
+	}))
+	problems := func(_ any, err error) []FieldProblem {
+		validationError := &ValidationError{}
+		if !errors.Is(err, ErrValidation) || !errors.As(err, &validationError) {
+			t.Error("Didn't return a validation error:", err)
+			return nil
+		}
+		return validationError.Problems
+	}
+
+	// Valid data reaches the route, both as a value and a pointer
+	if data, err := manager.Await("order", testOrder{Item: "box", Quantity: 3, Speed: "express"}); err != nil || data.(int) != 3 {
+		t.Error("Refused a valid request:", data, err)
+	}
+
+	// Struct tags are checked field by field, and the handler never sees the bad data
+	found := problems(manager.Await("order", testOrder{Quantity: 500, Speed: "slow", Notes: []string{"a", "b", "c"}}))
+	want := []FieldProblem{
+		{"item", "is required"},
+		{"quantity", "must be at most 100"},
+		{"speed", "must be one of standard, express"},
+		{"notes", "must be at most 2"},
+	}
+	if len(found) != len(want) {
+		t.Fatal("Didn't find every problem:", found)
+	}
+	for i := range want {
+		if found[i] != want[i] {
+			t.Error("Wrong problem:", found[i], "wanted", want[i])
+		}
+	}
+	if found := problems(manager.Await("order", "box")); len(found) != 1 || !strings.Contains(found[0].Problem, "must be a managers.testOrder") {
+		t.Error("Didn't check the type:", found)
+	}
+
+	// Schemas check maps, structs and raw JSON alike
+	if _, err := manager.Await("person", map[string]any{"name": "Ann", "age": 30, "tags": []string{"a"}}); err != nil {
+		t.Error("Refused a valid map:", err)
+	}
+	if _, err := manager.Await("person", json.RawMessage(`{"name": "Bo", "age": 4}`)); err != nil {
+		t.Error("Refused valid raw JSON:", err)
+	}
+	found = problems(manager.Await("person", json.RawMessage(`{"name": "", "age": 1.5, "tags": ["a", "c"]}`)))
+	if len(found) != 3 || found[0].Field != "age" || found[1].Field != "name" || found[2].Field != "tags[1]" {
+		t.Error("Didn't find every schema problem:", found)
+	}
+
+	// The schemas are published through Info and the debug endpoint
+	for _, route := range manager.Info().Routes {
+		if route.Route == "order" && (route.Input == nil || route.Input.Properties["quantity"].Maximum == nil || route.Input.Required[0] != "item") {
+			t.Error("Didn't describe the struct:", route.Input)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	DebugHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/?format=json&manager=Validation+Manager", nil))
+	if !strings.Contains(recorder.Body.String(), `"minLength": 1`) {
+		t.Error("Didn't publish the schema:", recorder.Body.String())
+	}
+
+	// Types which refer back to themselves stop at the first repeat
+	manager.Attach("node", func(managerState any, request any) any { return "ok" }, Input(TypeOf(testNode{})))
+	for _, route := range manager.Info().Routes {
+		if route.Route != "node" {
+			continue
+		}
+		if next := route.Input.Properties["next"]; next == nil || next.Type != "object" || next.Properties != nil {
+			t.Error("Didn't cut the self reference short:", next)
+		}
+		if children := route.Input.Properties["children"]; children == nil || children.Items == nil || children.Items.Type != "object" {
+			t.Error("Didn't describe the self referencing slice:", children)
+		}
+	}
+	if _, err := manager.Await("node", testNode{Value: 1, Next: &testNode{Value: 2}}); err != nil {
+		t.Error("Refused a valid linked value:", err)
+	}
+
+	// Data which points back to itself is only checked once
+	circular := &testNode{Value: 1}
+	circular.Next = circular
+	request := manager.Send("node", *circular)
+	select {
+	case <-request.Done():
+		if _, err := request.Wait(); err != nil {
+			t.Error("Refused a valid circular value:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish checking a circular value")
+	}
+
+	if err := manager.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+type testShipment struct {
+	ID     string
+	Weight float64
+	Tags   []string
+	Sent   time.Time
+}
+
+func Test_Codecs(t *testing.T) {
+
+	registry := NewCodecRegistry()
+	if err := registry.RegisterType("test.shipment/v1", testShipment{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.RegisterType("test.shipment/v1", State{}); err == nil {
+		t.Error("Registered two types under one name")
+	}
+	shipment := testShipment{ID: "abc", Weight: 2.5, Tags: []string{"fragile"}, Sent: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	now := time.Now()
+
+	// Every codec round trips the plain values, keeping their Go types
+	values := []any{
+		nil, true, "text", 42, int8(-3), uint64(1 << 40), 3.25, float32(1.5), []byte{1, 2, 3}, now,
+		[]string{"a", "b"}, map[string]string{"k": "v"},
+		[]any{"x", int64(2), true}, map[string]any{"nested": []any{"y", 1.5}},
+	}
+	for _, codec := range []string{"json", "gob", "binary"} {
+		registry.SetDefault(codec)
+		for _, value := range values {
+			if codec == "json" {
+				if _, ok := value.([]any); ok {
+					continue // JSON can't tell an int64 from a float64 inside of an interface
+				}
+			}
+			encoded, err := registry.Encode("", value)
+			if err != nil {
+				t.Error(codec, "couldn't encode", value, err)
+				continue
+			}
+			decoded, err := registry.Decode(encoded)
+			if err != nil {
+				t.Error(codec, "couldn't decode", value, err)
+				continue
+			}
+			if moment, ok := value.(time.Time); ok {
+				if !moment.Equal(decoded.(time.Time)) {
+					t.Error(codec, "changed the time:", value, decoded)
+				}
+			} else if !reflect.DeepEqual(value, decoded) {
+				t.Errorf("%s didn't round trip %#v, got %#v", codec, value, decoded)
+			}
+		}
+	}
+	registry.SetDefault("json")
+
+	// Registered structs round trip with JSON and gob, and the binary codec refuses them
+	for _, codec := range []string{"json", "gob"} {
+		registry.UseForType(testShipment{}, codec)
+		encoded, _ := registry.Encode("", shipment)
+		if decoded, err := registry.Decode(encoded); err != nil || !reflect.DeepEqual(decoded, shipment) {
+			t.Error(codec, "didn't round trip the struct:", decoded, err)
+		}
+	}
+	registry.UseForType(testShipment{}, "binary")
+	if _, err := registry.Encode("", shipment); err == nil {
+		t.Error("Binary codec encoded a struct")
+	}
+
+	// The binary codec refuses numbers which don't fit the type they're decoded into
+	binary := BinaryCodec{}
+	for _, value := range []any{int64(300), int64(-1), 2.5, 1e300} {
+		data, _ := binary.Marshal(value)
+		var small uint8
+		if err := binary.Unmarshal(data, &small); err == nil {
+			t.Error("Decoded", value, "into a uint8 as", small)
+		}
+	}
+	data, _ := binary.Marshal([]any{int64(-100), 3.0})
+	var fitting []int8
+	if err := binary.Unmarshal(data, &fitting); err != nil || fitting[0] != -100 || fitting[1] != 3 {
+		t.Error("Refused numbers which fit:", fitting, err)
+	}
+
+	// Routes pick their codec ahead of the type, and the binary codec is compact
+	registry.UseForRoute("compact", "binary")
+	compact, _ := registry.Encode("compact", map[string]any{"n": 1})
+	verbose, _ := registry.Encode("", map[string]any{"n": 1})
+	if !bytes.Contains(compact, []byte("binary")) || len(compact)-len("binary") >= len(verbose)-len("json") {
+		t.Error("Didn't use the route's codec:", compact, verbose)
+	}
+
+	// Registered types can travel inside interface values with gob
+	registry.UseForRoute("ship", "gob")
+	request := NewRequest("ship", map[string]any{"shipment": shipment}).WithMetadata(MetadataTenant, "acme")
+	frame, err := registry.EncodeRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := registry.DecodeRequest(frame)
+	if err != nil || decoded.Route != "ship" || decoded.ID() != request.ID() || decoded.Metadata.Get(MetadataTenant) != "acme" {
+		t.Error("Didn't round trip the request:", decoded, err)
+	} else if !reflect.DeepEqual(decoded.Data.(map[string]any)["shipment"], shipment) {
+		t.Error("Didn't round trip the request data:", decoded.Data)
+	}
+
+	// Responses carry either data or an error
+	frame, _ = registry.EncodeResponse("ship", 7, nil)
+	if data, err := registry.DecodeResponse(frame); err != nil || data.(int) != 7 {
+		t.Error("Didn't round trip the response:", data, err)
+	}
+	frame, _ = registry.EncodeResponse("ship", nil, errors.New("test error"))
+	if _, err := registry.DecodeResponse(frame); err == nil || err.Error() != "test error" {
+		t.Error("Didn't round trip the error:", err)
+	}
+
+	// Unknown types and newer envelopes are refused
+	if _, err := registry.Encode("", struct{ X int }{}); !errors.Is(err, ErrUnknownType) {
+		t.Error("Encoded an unregistered type:", err)
+	}
+	encoded, _ := NewCodecRegistry().Encode("", 1)
+	encoded[1] = EnvelopeVersion + 1
+	if _, err := registry.Decode(encoded); !errors.Is(err, ErrEnvelope) {
+		t.Error("Decoded a newer envelope:", err)
+	}
+	if _, err := NewCodecRegistry().Decode(frame[1:]); !errors.Is(err, ErrEnvelope) {
+		t.Error("Decoded garbage:", err)
+	}
+
+}
+
+func Test_Retry(t *testing.T) {
+
+	manager := createHandledManager(t, "Retry Manager", 16)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: 5 * time.Millisecond, Jitter: 0.5}
+	calls := map[string][]int{}
+	ids := map[string][]string{}
+	failUntil := func(route string, attempt int, err error) Handler {
+		return func(managerState any, request *Request) any {
+			calls[route] = append(calls[route], request.Attempt())
+			ids[route] = append(ids[route], request.ID())
+			if request.Attempt() < attempt {
+				return err
+			}
+			return request.Attempt()
+		}
+	}
+	temporary := Retryable(errors.New("temporary"))
+	manager.AttachHandler("flaky", failUntil("flaky", 3, temporary), Retry(policy))
+	manager.AttachHandler("down", failUntil("down", 100, temporary), Retry(policy))
+	manager.AttachHandler("broken", failUntil("broken", 100, errors.New("permanent")), Retry(policy))
+	manager.AttachHandler("plain", failUntil("plain", 3, temporary))
+
+	exporter := NewInMemoryExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+
+	// The manager retries retryable failures itself, and the caller sees the final result
+	if data, err := manager.Await("flaky", nil); err != nil || data.(int) != 3 || len(calls["flaky"]) != 3 {
+		t.Error("Didn't retry the route:", data, err, calls["flaky"])
+	}
+	if _, err := manager.Await("down", nil); !errors.Is(err, temporary) || !IsRetryable(err) || len(calls["down"]) != 3 {
+		t.Error("Didn't stop after the last attempt:", err, calls["down"])
+	}
+	if _, err := manager.Await("broken", nil); err == nil || IsRetryable(err) || len(calls["broken"]) != 1 {
+		t.Error("Retried an error which wasn't retryable:", err, calls["broken"])
+	}
+
+	// The sender can retry too, with every attempt carrying the same request id
+	if data, err := manager.AwaitRetry(context.Background(), policy, "plain", nil); err != nil || data.(int) != 3 {
+		t.Error("Didn't retry from the sending side:", data, err)
+	}
+	if ids["plain"][0] != ids["plain"][2] || calls["plain"][2] != 3 {
+		t.Error("Didn't keep the request id across attempts:", ids["plain"], calls["plain"])
+	}
+
+	// Each attempt is traced
+	attempts := map[string]bool{}
+	for _, span := range exporter.Spans() {
+		if span.Attributes["manager.route"] == "flaky" && span.Name == "process flaky" {
+			attempts[span.Attributes["request.attempt"]] = true
+		}
+	}
+	if !attempts["1"] || !attempts["2"] || !attempts["3"] {
+		t.Error("Didn't trace every attempt:", attempts)
+	}
+
+	// Once the budget is spent, failures come straight back
+	manager.SetRetryBudget(1, time.Hour)
+	calls["down"] = nil
+	manager.Await("down", nil)
+	if len(calls["down"]) != 2 {
+		t.Error("Didn't stop retrying once the budget was spent:", calls["down"])
+	}
+	info := manager.Info()
+	if info.Retries != 7 || info.RetriesRefused != 1 {
+		t.Error("Didn't count the retries:", info.Retries, info.RetriesRefused)
+	}
+	for _, route := range info.Routes {
+		if route.Route == "flaky" && (route.Retries != 2 || route.Calls != 3) {
+			t.Error("Didn't count the route's retries:", route)
+		}
+	}
+
+	// Backoff grows with each retry up to the maximum
+	backoff := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	if backoff.backoff(1) != 10*time.Millisecond || backoff.backoff(2) != 20*time.Millisecond || backoff.backoff(3) != 30*time.Millisecond {
+		t.Error("Didn't back off exponentially:", backoff.backoff(1), backoff.backoff(2), backoff.backoff(3))
+	}
+	backoff.Jitter = 0.5
+	if wait := backoff.backoff(1); wait < 5*time.Millisecond || wait > 10*time.Millisecond {
+		t.Error("Jittered outside of the range:", wait)
+	}
+
+	// Retries still waiting when the manager stops fail like any other request, and are
+	// 	never picked up by the next run
+	manager.SetRetryBudget(0, 0)
+	manager.AttachHandler("patient", failUntil("patient", 100, temporary), Retry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}))
+	deadLetters := NewDeadLetterQueue(16)
+	manager.SetDeadLetterQueue(deadLetters)
+	hooked := make(chan error, 1)
+	manager.OnError(func(managerState any, request *Request, err error) {
+		if request.Route == "patient" {
+			hooked <- err
+		}
+	})
+	request := manager.Send("patient", nil)
+	manager.Await("get", nil)
+	if err := manager.Kill(); err != nil {
+		t.Error(err)
+	}
+	var managerError *ManagerError
+	if _, err := request.Wait(); !errors.Is(err, temporary) || !errors.As(err, &managerError) {
+		t.Error("Didn't fail the waiting retry:", err)
+	}
+	if err := <-hooked; !errors.Is(err, temporary) || deadLetters.Len() != 1 {
+		t.Error("Didn't report the waiting retry:", err, deadLetters.Len())
+	}
+	go manager.Start(&State{})
+	manager.Await("get", nil)
+	if len(calls["patient"]) != 1 {
+		t.Error("Picked up the retry in the next run:", calls["patient"])
+	}
+
+	if err := manager.KillAndRemove(); err != nil {
+		t.Fail()
+	}
+
+}
+
+func Test_DeadLetters(t *testing.T) {
+
+	manager := createHandledManager(t, "Dead Letter Manager", 16)
+	deadLetters := NewDeadLetterQueue(0)
+	manager.SetDeadLetterQueue(deadLetters)
+	manager.WaitUntilRunning(context.Background())
+
+	broken := true
+	manager.Attach("charge", func(managerState any, request any) any {
+		if broken {
+			return errors.New("test error")
+		}
+		return request
+	})
+	manager.Attach("panic", func(any, any) any { panic("test panic") })
+	manager.AttachHandler("flaky", func(any, *Request) any { return Retryable(errors.New("temporary")) }, Retry(RetryPolicy{MaxAttempts: 2}))
+	release := make(chan bool)
+	manager.Attach("slow", func(any, any) any { <-release; return nil })
+
+	// Fire and forget failures are kept, with everything needed to look at them later
+	request := NewRequest("charge", 5).WithMetadata(MetadataTenant, "acme")
+	manager.SendRequest(request)
+	manager.Await("flaky", nil)
+
+	// A request whose context ends while it's queued is kept as a timeout
+	manager.Send("slow", nil)
+	expiring, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	manager.SendContext(expiring, "charge", 6)
+	<-expiring.Done()
+	release <- true
+	manager.Await("get", nil)
+
+	letters := deadLetters.List()
+	if len(letters) != 3 || manager.Info().DeadLetters != 3 {
+		t.Fatal("Didn't keep the failed requests:", letters)
+	}
+	if letters[0].ID != request.ID() || letters[0].Route != "charge" || letters[0].Data.(int) != 5 || letters[0].Reason != DeadLetterError ||
+		letters[0].Metadata.Get(MetadataTenant) != "acme" || letters[0].Manager != "Dead Letter Manager" || !strings.Contains(letters[0].Error.Error(), "test error") {
+		t.Error("Didn't describe the failed request:", letters[0])
+	}
+	if letters[1].Route != "flaky" || letters[1].Attempts != 2 {
+		t.Error("Didn't record the attempts:", letters[1])
+	}
+	if letters[2].Reason != DeadLetterTimeout {
+		t.Error("Didn't record the timeout:", letters[2])
+	}
+
+	// Replaying sends the request again with the same id, and removes it from the queue
+	broken = false
+	replayed, ok := deadLetters.Replay(request.ID())
+	if data, err := replayed.Wait(); !ok || err != nil || data.(int) != 5 || replayed.ID() != request.ID() {
+		t.Error("Didn't replay the request:", data, err)
+	}
+	if _, ok := deadLetters.Get(request.ID()); ok || deadLetters.Len() != 2 {
+		t.Error("Didn't take the replayed request out of the queue")
+	}
+	if count := deadLetters.Purge(); count != 2 || deadLetters.Len() != 0 {
+		t.Error("Didn't purge the queue:", count)
+	}
+
+	// Panics and requests left over at shutdown are kept as well
+	manager.Await("panic", nil)
+	go manager.Start(&State{})
+	manager.WaitUntilRunning(context.Background())
+	manager.Send("slow", nil)
+	killed := make(chan error)
+	go func() { killed <- manager.Kill() }()
+	for info := manager.Info(); info.CurrentRoute != "slow" || info.QueueLength == 0; info = manager.Info() {
+		<-time.After(time.Millisecond)
+	}
+	leftover := manager.Send("get", nil)
+	release <- true
+	if err := <-killed; err != nil {
+		t.Error(err)
+	}
+	if _, err := leftover.Wait(); !errors.Is(err, ErrStopped) {
+		t.Error("Didn't reject the leftover request:", err)
+	}
+	letters = deadLetters.List()
+	if len(letters) != 2 || letters[0].Reason != DeadLetterPanic || letters[1].Reason != DeadLetterRejected || letters[1].ID != leftover.ID() {
+		t.Error("Didn't keep the panic and the rejected request:", letters)
+	}
+
+	// A limited queue drops the oldest letters
+	limited := NewDeadLetterQueue(2)
+	for i := 0; i < 3; i++ {
+		limited.add(DeadLetter{ID: strconv.Itoa(i)})
+	}
+	if letters := limited.List(); len(letters) != 2 || letters[0].ID != "1" {
+		t.Error("Didn't drop the oldest letter:", letters)
+	}
+
+	if err := manager.Remove(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func Test_CircuitBreaker(t *testing.T) {
+
+	manager := createHandledManager(t, "Circuit Manager", 16)
+	manager.WaitUntilRunning(context.Background())
+
+	broken := true
+	manager.Attach("charge", func(managerState any, request any) any {
+		if broken {
+			return errors.New("test error")
+		}
+		return request
+	}, Breaker(CircuitPolicy{Window: 4, ErrorRate: 0.5, OpenFor: 20 * time.Millisecond}))
+	circuit := func(route string) *CircuitInfo {
+		for _, info := range manager.Info().Routes {
+			if info.Route == route {
+				return info.Circuit
+			}
+		}
+		return nil
+	}
+
+	// The breaker trips once the window is full of failures, and then fails fast
+	for i := 0; i < 4; i++ {
+		if _, err := manager.Await("charge", i); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("Tripped too early:", err)
+		}
+	}
+	if _, err := manager.Await("charge", 4); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("Didn't fail fast:", err)
+	}
+	if _, err := manager.SendContext(context.Background(), "charge", 5); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("Didn't fail fast with a context:", err)
+	}
+	if info := circuit("charge"); info == nil || info.State != CircuitOpen || info.Trips != 1 || info.Rejected != 2 {
+		t.Error("Didn't describe the open breaker:", info)
+	}
+	if circuit("get") != nil || manager.Info().Circuit != nil {
+		t.Error("Described a breaker which doesn't exist")
+	}
+	manager.Await("setValue", 3)
+	if data, err := manager.Await("square", nil); err != nil || data.(int) != 9 {
+		t.Error("The open breaker held up another route:", data, err)
+	}
+
+	// After a while a trial request goes through. A failure opens it again, a success closes it.
+	<-time.After(25 * time.Millisecond)
+	if info := circuit("charge"); info.State != CircuitHalfOpen {
+		t.Error("Didn't go half open:", info.State)
+	}
+	manager.Await("charge", 6)
+	if info := circuit("charge"); info.State != CircuitOpen || info.Trips != 2 {
+		t.Error("Didn't open again after a failed trial:", info)
+	}
+	<-time.After(25 * time.Millisecond)
+	broken = false
+	if data, err := manager.Await("charge", 7); err != nil || data.(int) != 7 {
+		t.Error("Didn't let the trial through:", data, err)
+	}
+	if info := circuit("charge"); info.State != CircuitClosed {
+		t.Error("Didn't close after a good trial:", info)
+	}
+
+	// Trials answered without reaching the route are handed back to the breaker
+	manager.Attach("refund", func(managerState any, request any) any {
+		if request.(int) < 0 {
+			return errors.New("test error")
+		}
+		return request
+	}, Input(TypeOf(0)), Breaker(CircuitPolicy{Window: 1, ErrorRate: 1, OpenFor: 20 * time.Millisecond}))
+	manager.Await("refund", -1)
+	<-time.After(25 * time.Millisecond)
+	if _, err := manager.Await("refund", "invalid"); !errors.Is(err, ErrValidation) {
+		t.Error("Didn't validate the trial:", err)
+	}
+	request := NewRequest("refund", 1).IfVersion(1000)
+	if _, err := manager.AwaitRequest(request); !errors.Is(err, ErrVersionConflict) {
+		t.Error("Didn't reject the stale trial:", err)
+	}
+	if data, err := manager.Await("refund", 8); err != nil || data.(int) != 8 {
+		t.Error("Didn't let a trial through after the refused ones:", data, err)
+	}
+	if info := circuit("refund"); info.State != CircuitClosed {
+		t.Error("Didn't close after a good trial:", info)
+	}
+
+	// Deferred calls count once they're completed, timed from when the route was called
+	fetch := func(managerState any, request any) any {
+		deferred := NewDeferred()
+		go func() {
+			<-time.After(10 * time.Millisecond)
+			if request.(int) < 0 {
+				deferred.Fail(errors.New("test error"))
+				return
+			}
+			deferred.Continue(func(any) any { return request })
+		}()
+		return deferred
+	}
+	manager.Attach("fetch", fetch, Breaker(CircuitPolicy{Window: 1, ErrorRate: 1, OpenFor: time.Hour}))
+	manager.Attach("lookup", fetch, Breaker(CircuitPolicy{Window: 1, SlowCall: 5 * time.Millisecond, SlowRate: 1, OpenFor: time.Hour}))
+	if _, err := manager.Await("fetch", -1); err == nil {
+		t.Error("Didn't fail the deferred call")
+	}
+	if info := circuit("fetch"); info.State != CircuitOpen {
+		t.Error("Didn't count the failed deferred call:", info)
+	}
+	if data, err := manager.Await("lookup", 1); err != nil || data.(int) != 1 {
+		t.Error("Didn't continue the deferred call:", data, err)
+	}
+	if info := circuit("lookup"); info.State != CircuitOpen {
+		t.Error("Didn't count the slow deferred call:", info)
+	}
+
+	// Requests for routes which don't exist never count, even with a not found handler
+	manager.NotFound(func(any, *Request) any { return errors.New("test error") })
+	manager.SetCircuitBreaker(CircuitPolicy{Window: 1, ErrorRate: 1, OpenFor: time.Hour})
+	manager.Await("missing", nil)
+	if _, err := manager.Await("get", nil); err != nil {
+		t.Error("Counted a request for a missing route:", err)
+	}
+	manager.NotFound(nil)
+
+	// A breaker around the whole manager, tripped by latency
+	manager.SetCircuitBreaker(CircuitPolicy{Window: 2, SlowCall: 5 * time.Millisecond, SlowRate: 1, OpenFor: time.Hour})
+	manager.Attach("slow", func(any, any) any { <-time.After(10 * time.Millisecond); return nil })
+	manager.Await("slow", nil)
+	manager.Await("get", nil)
+	if info := manager.Info().Circuit; info == nil || info.State != CircuitClosed || info.SlowRate != 0.5 {
+		t.Error("Tripped too early:", info)
+	}
+	manager.Await("slow", nil)
+	manager.Await("slow", nil)
+	if _, err := manager.Await("get", nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("Didn't fail fast:", err)
+	}
+	manager.SetCircuitBreaker(CircuitPolicy{})
+	if _, err := manager.Await("get", nil); err != nil || manager.Info().Circuit != nil {
+		t.Error("Didn't remove the breaker:", err)
+	}
+
+	if err := manager.KillAndRemove(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func Test_DiskQueue(t *testing.T) {
+
+	directory := t.TempDir()
+	queue, err := OpenDiskQueue(directory, DiskQueueOptions{SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := createHandledManager(t, "Disk Manager", 16)
+	manager.WaitUntilRunning(context.Background())
+	if recovered, err := manager.SetDiskQueue(queue); err != nil || len(recovered) != 0 {
+		t.Fatal("Recovered requests from an empty directory:", recovered, err)
+	}
+
+	// Answered requests are acknowledged, and their segments cleaned up
+	for i := 0; i < 20; i++ {
+		manager.Await("setValue", i)
+	}
+	if queue.Unacknowledged() != 0 || manager.Info().Unacknowledged != 0 {
+		t.Error("Didn't acknowledge the answered requests:", queue.Unacknowledged())
+	}
+	if segments, _ := filepath.Glob(filepath.Join(directory, "*.segment")); len(segments) != 1 {
+		t.Error("Didn't remove the acknowledged segments:", segments)
+	}
+
+	// Requests which were never answered are still on disk after a crash
+	release := make(chan bool)
+	manager.Attach("slow", func(any, any) any { <-release; return nil })
+	manager.Send("slow", nil)
+	manager.Send("setValue", 40)
+	request := NewRequest("setValue", 41).WithMetadata(MetadataTenant, "acme")
+	manager.SendRequest(request)
+	if queue.Unacknowledged() != 3 || manager.Info().Unacknowledged != 3 {
+		t.Error("Didn't keep the queued requests:", queue.Unacknowledged())
+	}
+	queue.Close()
+	release <- true
+	request.Wait()
+	if _, err := manager.Await("get", nil); !errors.Is(err, ErrQueueClosed) {
+		t.Error("Accepted a request into a closed queue:", err)
+	}
+	manager.SetDiskQueue(nil)
+	if err := manager.KillAndRemove(); err != nil {
+		t.Error(err)
+	}
+
+	// A torn write at the end of a segment is ignored
+	segments, _ := filepath.Glob(filepath.Join(directory, "*.segment"))
+	file, _ := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0o644)
+	file.Write([]byte{diskRecordRequest, 99, 40, 1, 2})
+	file.Close()
+
+	// Opening the queue again delivers them to the new manager, in order, keeping their ids
+	queue, err = OpenDiskQueue(directory, DiskQueueOptions{Sync: SyncInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager = createHandledManager(t, "Disk Manager", 16)
+	manager.Attach("slow", func(any, any) any { return nil })
+	recovered, err := manager.SetDiskQueue(queue)
+	if err != nil || len(recovered) != 3 || recovered[0].Route != "slow" || recovered[2].ID() != request.ID() || recovered[2].Metadata.Get(MetadataTenant) != "acme" {
+		t.Fatal("Didn't recover the requests:", recovered, err)
+	}
+	for _, request := range recovered {
+		if _, err := request.Wait(); err != nil {
+			t.Error(err)
+		}
+	}
+	if data, _ := manager.Await("get", nil); data.(*State).Value != 41 {
+		t.Error("Didn't process the recovered requests:", data)
+	}
+	if queue.Unacknowledged() != 0 {
+		t.Error("Didn't acknowledge the recovered requests:", queue.Unacknowledged())
+	}
+	if recovered, _ := manager.SetDiskQueue(queue); len(recovered) != 0 {
+		t.Error("Recovered the same requests twice:", recovered)
+	}
+
+	// Data the codecs can't encode is refused rather than lost
+	if _, err := manager.Await("setValue", make(chan int)); err == nil {
+		t.Error("Accepted a request which can't be written to disk")
+	}
+
+	if err := manager.KillAndRemove(); err != nil {
+		t.Error(err)
+	}
+	if err := queue.Close(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func Test_Queues(t *testing.T) {
+
+	// Queued requests come out of a priority queue highest priority first
+	manager, err := NewManager("Queue Manager", 0, WithQueue(NewPriorityQueue(0, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := []int{}
+	manager.Attach("record", func(_ any, request any) any {
+		order = append(order, request.(int))
+		return nil
+	})
+	for i, priority := range []string{"1", "5", "", "5", "9"} {
+		manager.SendRequest(NewRequest("record", i).WithMetadata(MetadataPriority, priority))
+	}
+	if info := manager.Info(); info.QueueLength != 5 || info.QueueCapacity != -1 {
+		t.Error("Didn't describe the queue:", info.QueueLength, info.QueueCapacity)
+	}
+	go manager.Start(nil)
+	manager.Await("record", -1)
+	if !reflect.DeepEqual(order, []int{4, 1, 3, 0, 2, -1}) {
+		t.Error("Didn't process in priority order:", order)
+	}
+	if err := manager.KillAndRemove(); err != nil {
+		t.Error(err)
+	}
+
+	// A ring queue never blocks, and closing it stops the manager
+	queue := NewRingQueue()
+	manager, _ = NewManager("Queue Manager", 0, WithQueue(queue))
+	manager.Attach("record", func(_ any, request any) any { return request })
+	requests := make([]*Request, 100)
+	for i := range requests {
+		requests[i] = manager.Send("record", i)
+	}
+	stopped := make(chan error)
+	go func() { stopped <- manager.Start(nil) }()
+	for i, request := range requests {
+		if data, err := request.Wait(); err != nil || data.(int) != i {
+			t.Fatal("Didn't process the ring queue in order:", data, err)
+		}
+	}
+	queue.Close()
+	if err := <-stopped; !errors.Is(err, ErrQueueClosed) || manager.State() != LifecycleStopped {
+		t.Error("Didn't stop when the queue closed:", err, manager.State())
+	}
+	if _, err := manager.Await("record", 1); !errors.Is(err, ErrQueueClosed) {
+		t.Error("Sent a request to a closed queue:", err)
+	}
+	manager.Remove()
+
+	// Bounded queues block while they're full, and give up when the context ends
+	for _, bounded := range []Queue{NewChannelQueue(1), NewPriorityQueue(1, func(*Request) int { return 0 })} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		if err := bounded.Enqueue(ctx, NewRequest("first", nil)); err != nil || bounded.Cap() != 1 {
+			t.Error("Didn't queue the request:", err)
+		}
+		if err := bounded.Enqueue(ctx, NewRequest("second", nil)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("Didn't block on a full queue:", err)
+		}
+		cancel()
+		bounded.Close()
+		if err := bounded.Enqueue(context.Background(), NewRequest("third", nil)); !errors.Is(err, ErrQueueClosed) {
+			t.Error("Accepted a request after closing:", err)
+		}
+		if request, err := bounded.Dequeue(ctx); err != nil || request.Route != "first" {
+			t.Error("Didn't hand out what was left after closing:", err)
+		}
+		if _, err := bounded.Dequeue(context.Background()); !errors.Is(err, ErrQueueClosed) {
+			t.Error("Didn't report the closed queue:", err)
+		}
+	}
+
+	// A disk queue keeps the requests which never made it to the manager
+	directory := t.TempDir()
+	disk, err := OpenDiskQueue(directory, DiskQueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, _ = NewManager("Queue Manager", 0, WithQueue(disk))
+	var rejected []*Request
+	for i := 1; i <= 3; i++ {
+		rejected = append(rejected, manager.Send("setValue", i))
+	}
+	if manager.Info().Unacknowledged != 3 {
+		t.Error("Didn't write the requests to disk")
+	}
+
+	// Requests rejected as the manager stops, or dropped as the queue closes, are answered
+	// 	but stay on disk
+	manager.OnStart(func(any) error { return errors.New("test error") })
+	manager.Start(&State{})
+	for _, request := range rejected {
+		if _, err := request.Wait(); !errors.Is(err, ErrStopped) {
+			t.Error("Didn't reject the queued request:", err)
+		}
+	}
+	dropped := manager.Send("setValue", 4)
+	disk.Close()
+	select {
+	case <-dropped.Done():
+		if _, err := dropped.Wait(); !errors.Is(err, ErrQueueClosed) {
+			t.Error("Didn't answer the dropped request:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Left the dropped request waiting")
+	}
+	manager.Remove()
+
+	disk, _ = OpenDiskQueue(directory, DiskQueueOptions{})
+	if disk.Len() != 4 {
+		t.Error("Didn't recover the requests:", disk.Len())
+	}
+	manager, _ = NewManager("Queue Manager", 0, WithQueue(disk))
+	manager.Attach("get", getTestState)
+	manager.Attach("setValue", setTestValue)
+	go manager.Start(&State{})
+	if data, err := manager.Await("get", nil); err != nil || data.(*State).Value != 4 || disk.Unacknowledged() != 0 {
+		t.Error("Didn't process the recovered requests:", data, err)
+	}
+	if err := manager.KillAndRemove(); err != nil {
+		t.Error(err)
+	}
+	disk.Close()
+
+}
+
+// testPanicker is an authorizer and validator which panics
+type testPanicker struct{}
+
+func (testPanicker) Authorize(string, *Request, []string) error { panic("test panic") }
+func (testPanicker) Validate(any) error                         { panic("test panic") }
+func (testPanicker) Schema() *Schema                            { return nil }
+
+// testMetrics records every request reported to it
+type testMetrics struct {
+	routes []string
+	errors int
+}
+
+func (metrics *testMetrics) RequestProcessed(managerName string, route string, waited time.Duration, took time.Duration, err error) {
+	metrics.routes = append(metrics.routes, managerName+"/"+route)
+	if err != nil {
+		metrics.errors++
+	}
+}
+
+func Test_Options(t *testing.T) {
+
+	// With no options, New behaves like NewManager always has
+	manager, err := New("Options Manager")
+	if err != nil || manager.Info().QueueCapacity != DefaultBufferSize {
+		t.Fatal("Didn't create the default manager:", err)
+	}
+	if found, err := GetManager("Options Manager"); err != nil || found != manager {
+		t.Error("Didn't add the manager to the default registry:", err)
+	}
+	if _, err := New("Options Manager"); !errors.Is(err, ErrManagerExists) {
+		t.Error("Created a duplicate manager:", err)
+	}
+	manager.Remove()
+
+	// Every other option
+	registry := NewRegistry()
+	logs := &bytes.Buffer{}
+	metrics := &testMetrics{}
+	started, failures := false, 0
+	manager, err = New("Options Manager",
+		WithBufferSize(4),
+		WithRegistry(registry),
+		WithLogger(log.New(logs, "", 0)),
+		WithTimeout(20*time.Millisecond),
+		WithStartHook(func(any) error { started = true; return nil }),
+		WithErrorHook(func(any, *Request, error) { failures++ }),
+		WithPanicPolicy(PanicRecover),
+		WithMetrics(metrics),
+	)
+	if err != nil || manager.Info().QueueCapacity != 4 {
+		t.Fatal("Didn't create the manager:", err)
+	}
+	if _, err := GetManager("Options Manager"); !errors.Is(err, ErrManagerNotFound) {
+		t.Error("Added the manager to the default registry:", err)
+	}
+	if found, err := registry.Get("Options Manager"); err != nil || found != manager || len(registry.List()) != 1 {
+		t.Error("Didn't add the manager to its registry:", err)
+	}
+
+	release := make(chan bool)
+	manager.Attach("echo", func(_ any, request any) any { return request })
+	manager.Attach("panic", func(any, any) any { panic("test panic") })
+	manager.Attach("slow", func(any, any) any { <-release; return nil })
+	go manager.Start(nil)
+	manager.WaitUntilRunning(context.Background())
+	if !started {
+		t.Error("Didn't run the start hook")
+	}
+
+	// Panics are answered instead of stopping the manager
+	if _, err := manager.Await("panic", nil); !errors.Is(err, ErrPanic) || !manager.IsRunning() {
+		t.Error("Didn't recover from the panic:", err)
+	}
+	if data, err := manager.Await("echo", 5); err != nil || data.(int) != 5 {
+		t.Error("Didn't carry on after the panic:", data, err)
+	}
+	if failures != 1 || !strings.Contains(logs.String(), "Error in manager, Options Manager") || !strings.Contains(logs.String(), "test panic") {
+		t.Error("Didn't report the panic:", failures, logs.String())
+	}
+	if len(metrics.routes) != 2 || metrics.routes[1] != "Options Manager/echo" || metrics.errors != 1 {
+		t.Error("Didn't report the metrics:", metrics.routes, metrics.errors)
+	}
+
+	// Requests stuck in the queue time out
+	manager.Send("slow", nil)
+	request := manager.Send("echo", 6)
+	if _, err := manager.Await("echo", 7); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Didn't time out:", err)
+	}
+	if request.Metadata.Get(MetadataDeadline) == "" {
+		t.Error("Didn't put the deadline on the request")
+	}
+	if _, err := manager.AwaitRequest(NewRequest("echo", 8)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Didn't time out a premade request:", err)
+	}
+	<-request.Context().Done()
+	release <- true
+	if _, err := request.Wait(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Processed a request after its deadline:", err)
+	}
+
+	if err := manager.Kill(); err != nil {
+		t.Error(err)
+	}
+	if err := manager.Remove(); err != nil || len(registry.List()) != 0 {
+		t.Error("Didn't remove the manager from its registry:", err)
+	}
+
+	// NewManager is New with a buffer size
+	manager, err = NewManager("Options Manager", 2, WithRegistry(registry))
+	if err != nil || manager.Info().QueueCapacity != 2 {
+		t.Error("Didn't pass the options along:", err)
+	}
+	if _, err := GetManager("Options Manager"); err == nil {
+		t.Error("Added the manager to the default registry")
+	}
+
+}
+
+func Test_Snapshots(t *testing.T) {
+
+	manager, err := NewManager("Snapshot Manager", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := manager.Read(); snapshot.Version != 0 || snapshot.State != nil {
+		t.Error("Read a snapshot before one was published:", snapshot)
+	}
+	manager.Attach("get", getTestState)
+	manager.Attach("square", getTestSquare)
+	manager.Attach("setValue", setTestValue, Write())
+	manager.Attach("fail", func(managerState any, request any) any {
+		managerState.(*State).Value = -1
+		return errors.New("test error")
+	}, Write())
+	manager.SetSnapshot(func(managerState any) any { return *managerState.(*State) })
+
+	// A snapshot is published when the manager starts, and after every write
+	go manager.Start(&State{Status: "Starting Up", Value: 2})
+	manager.WaitUntilRunning(context.Background())
+	if state, version, ok := ReadAs[State](manager); !ok || version != 0 || state.Value != 2 || manager.Read().Version != 1 {
+		t.Error("Didn't publish the starting state:", state, version)
+	}
+	manager.Await("setValue", 5)
+	manager.Await("square", nil)
+	manager.Await("fail", nil)
+	if state, version, ok := ReadAs[State](manager); !ok || version != 1 || state.Value != 5 || manager.Read().Version != 2 {
+		t.Error("Didn't publish exactly the successful writes:", state, version)
+	}
+	if _, _, ok := ReadAs[*State](manager); ok {
+		t.Error("Read the snapshot as the wrong type")
+	}
+
+	// Snapshots can be read concurrently while the manager is busy writing
+	done := make(chan bool)
+	go func() {
+		last := uint64(0)
+		for i := 0; i < 1000; i++ {
+			snapshot := manager.Read()
+			if snapshot.Version < last {
+				t.Error("Snapshot went back in time:", snapshot.Version, last)
+			}
+			last = snapshot.Version
+		}
+		done <- true
+	}()
+	for i := 0; i < 50; i++ {
+		manager.Send("setValue", i)
+	}
+	<-done
+
+	// Handlers can publish whatever they like
+	release := make(chan bool)
+	manager.Attach("publish", func(managerState any, request any) any {
+		manager.Publish(request)
+		<-release
+		return nil
+	})
+	request := manager.Send("publish", "custom")
+	for manager.Read().State != "custom" {
+		<-time.After(time.Millisecond)
+	}
+	if manager.Info().SnapshotVersion != manager.Read().Version || manager.Info().SnapshotVersion != 53 {
+		t.Error("Didn't report the snapshot version:", manager.Info().SnapshotVersion)
+	}
+	release <- true
+	request.Wait()
+
+	// Restarts publish the new state
+	manager.Restart(&State{Value: 9})
+	if state, _, _ := ReadAs[State](manager); state.Value != 9 {
+		t.Error("Didn't publish the restarted state:", state)
+	}
+
+	if err := manager.KillAndRemove(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func Test_Versioning(t *testing.T) {
+
+	manager, err := NewManager("Versioning Manager", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Attach("get", getTestState)
+	manager.Attach("setValue", setTestValue, Write())
+	manager.Attach("fail", func(managerState any, request any) any {
+		return errors.New("test error")
+	}, Write())
+	manager.SetSnapshot(func(managerState any) any { return *managerState.(*State) })
+	go manager.Start(&State{Value: 2})
+	manager.WaitUntilRunning(context.Background())
+
+	// Every successful write moves the version on. Reads and failed writes don't.
+	if version := manager.Version(); version != 0 {
+		t.Error("Didn't start at version zero:", version)
+	}
+	manager.Await("setValue", 3)
+	manager.Await("get", nil)
+	manager.Await("fail", nil)
+	if version := manager.Version(); version != 1 || manager.Info().Version != 1 {
+		t.Error("Didn't version the writes:", version, manager.Info().Version)
+	}
+	if state, version, ok := ReadAs[State](manager); !ok || version != 1 || state.Value != 3 {
+		t.Error("Didn't publish the state version:", state, version)
+	}
+
+	// Requests expecting the current version are processed, stale ones are rejected
+	request := NewRequest("setValue", 4).IfVersion(1)
+	manager.SendRequest(request)
+	if _, err := request.Wait(); err != nil {
+		t.Error(err)
+	}
+	if version, ok := request.ExpectedVersion(); !ok || version != 1 {
+		t.Error("Didn't keep the expected version:", version, ok)
+	}
+	request = NewRequest("setValue", 5).IfVersion(1)
+	manager.SendRequest(request)
+	var managerError *ManagerError
+	if _, err := request.Wait(); !errors.Is(err, ErrVersionConflict) || !errors.As(err, &managerError) || managerError.Op != "version" {
+		t.Error("Didn't reject the stale write:", err)
+	}
+	if state, _ := manager.Await("get", nil); state.(*State).Value != 4 || manager.Version() != 2 {
+		t.Error("Stale write changed the state:", state, manager.Version())
+	}
+
+	// Expected versions which aren't numbers never match
+	request = NewRequest("get", nil).WithMetadata(MetadataExpectedVersion, "latest")
+	manager.SendRequest(request)
+	if _, err := request.Wait(); !errors.Is(err, ErrVersionConflict) {
+		t.Error("Accepted an invalid expected version:", err)
+	}
+	if _, ok := NewRequest("get", nil).ExpectedVersion(); ok {
+		t.Error("Unconditional request expected a version")
+	}
+
+	// Concurrent read-modify-write cycles only ever let one writer through per version
+	results := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			request := NewRequest("setValue", i).IfVersion(2)
+			manager.SendRequest(request)
+			_, err := request.Wait()
+			results <- err
+		}(i)
+	}
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 || manager.Version() != 3 {
+		t.Error("Let more than one writer through:", succeeded, manager.Version())
+	}
+
+	// A failed write doesn't leave the snapshot behind, so reading again always works
+	manager.Await("fail", nil)
+	_, version, _ := ReadAs[State](manager)
+	if _, err := manager.AwaitRequest(NewRequest("setValue", 6).IfVersion(version)); err != nil || version != manager.Version()-1 {
+		t.Error("Conflicted with the latest snapshot:", version, err)
+	}
+
+	// Writes in transactions and Deferred continuations are versioned and published too
+	if _, err := NewTransaction(time.Second).Add(TransactionStep{Manager: manager, Prepare: "get", Commit: "setValue", Data: 7}).Execute(); err != nil {
+		t.Error(err)
+	}
+	if state, version, _ := ReadAs[State](manager); version != 5 || state.Value != 7 {
+		t.Error("Didn't version the transaction:", state, version)
+	}
+	manager.Attach("later", func(managerState any, request any) any {
+		deferred := NewDeferred()
+		if request.(int) < 0 {
+			go deferred.Fail(errors.New("test error"))
+			return deferred
+		}
+		go deferred.Continue(func(managerState any) any {
+			managerState.(*State).Value = request.(int)
+			return nil
+		})
+		return deferred
+	}, Write())
+	manager.Await("later", 8)
+	if state, version, _ := ReadAs[State](manager); version != 6 || manager.Version() != 6 || state.Value != 8 {
+		t.Error("Didn't version the continuation once:", state, version, manager.Version())
+	}
+	manager.Await("later", -1)
+	if state, version, _ := ReadAs[State](manager); version != 6 || manager.Version() != 6 || state.Value != 8 {
+		t.Error("Versioned a failed deferred write:", state, version, manager.Version())
+	}
+
+	// Transactions which roll back never publish their writes, even part way through
+	partner, _ := NewManager("Versioning Partner", 16)
+	stalled, release := make(chan bool), make(chan bool)
+	partner.Attach("get", getTestState)
+	partner.Attach("stall", func(any, any) any { stalled <- true; <-release; return errors.New("test error") })
+	go partner.Start(&State{})
+	partner.WaitUntilRunning(context.Background())
+	previous, version, _ := ReadAs[State](manager)
+	manager.Attach("undo", func(managerState any, request any) any {
+		managerState.(*State).Value = previous.Value
+		return nil
+	}, Write())
+	aborted := make(chan error)
+	go func() {
+		_, err := NewTransaction(time.Second).
+			Add(TransactionStep{Manager: manager, Prepare: "get", Commit: "setValue", Rollback: "undo", Data: 10}).
+			Add(TransactionStep{Manager: partner, Prepare: "get", Commit: "stall"}).
+			Execute()
+		aborted <- err
+	}()
+	<-stalled
+	if state, published, _ := ReadAs[State](manager); published != version || state.Value != previous.Value {
+		t.Error("Published part of a transaction:", state, published)
+	}
+	release <- true
+	if err := <-aborted; !errors.Is(err, ErrTransactionAborted) {
+		t.Error("Didn't abort the transaction:", err)
+	}
+	if state, published, _ := ReadAs[State](manager); published != version || manager.Version() != version || state.Value != previous.Value {
+		t.Error("Versioned a transaction which rolled back:", state, published, manager.Version())
+	}
+	partner.KillAndRemove()
+
+	// Snapshots a write publishes itself carry the version it moved the state on to
+	manager.SetSnapshot(nil)
+	manager.Attach("publish", func(managerState any, request any) any {
+		managerState.(*State).Value = request.(int)
+		manager.Publish(*managerState.(*State))
+		return nil
+	}, Write())
+	manager.Await("publish", 9)
+	if state, version, _ := ReadAs[State](manager); version != manager.Version() || state.Value != 9 {
+		t.Error("Didn't stamp the published snapshot:", state, version, manager.Version())
+	}
+
+	// Restarting moves the version on too
+	manager.SetSnapshot(func(managerState any) any { return *managerState.(*State) })
+	before := manager.Version()
+	manager.Restart(&State{Value: 9})
+	if version := manager.Version(); version != before+1 || manager.Read().StateVersion != version {
+		t.Error("Didn't version the restart:", version, manager.Read().StateVersion)
+	}
+
+	if err := manager.KillAndRemove(); err != nil {
+		t.Error(err)
+	}
+
+}
+
 /////////////////////////
 // INTERNAL TEST SETUP //
 /////////////////////////
@@ -0,0 +1,185 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+Pattern routes let a single attached function handle a whole family of routes. A route is a
+pattern if it contains a parameter or ends with a wildcard:
+
+	account/{id}/balance  matches "account/42/balance" with the parameter id = "42"
+	files/*               matches "files/a/b.txt" with the parameter * = "a/b.txt"
+	*                     matches every route which nothing else handles
+
+Parameters match one or more characters up to the next "/". The wildcard matches everything
+left in the route (including nothing). When a request comes in, the manager picks a handler
+using these rules, in order:
+
+ 1. A route attached with exactly the requested name always wins.
+ 2. Patterns without a wildcard beat patterns with one.
+ 3. Patterns with more literal (non parameter) characters win.
+ 4. Patterns with fewer parameters win.
+ 5. Otherwise the pattern which sorts first alphabetically wins.
+
+If nothing matches, the request goes to the not found handler (see manager.NotFound()).
+*/
+
+// routePattern is the compiled form of a pattern route.
+type routePattern struct {
+	source     string
+	expression *regexp.Regexp
+	params     []string
+	literal    int
+	wildcard   bool
+}
+
+// WildcardParam is the name of the parameter holding whatever a trailing wildcard matched.
+const WildcardParam = "*"
+
+// compilePattern compiles a route into a pattern. If the route doesn't have any parameters
+// 	or a wildcard, it isn't a pattern and nil is returned.
+func compilePattern(route string) *routePattern {
+
+	pattern := &routePattern{source: route}
+	rest := route
+	if strings.HasSuffix(rest, WildcardParam) {
+		pattern.wildcard = true
+		rest = strings.TrimSuffix(rest, WildcardParam)
+	}
+
+	// Walk through the route, turning literal text into escaped text and parameters into
+	// 	capture groups.
+	expression := strings.Builder{}
+	expression.WriteString("^")
+	for rest != "" {
+
+		open := strings.Index(rest, "{")
+		end := -1
+		if open >= 0 {
+			end = strings.Index(rest[open:], "}")
+		}
+
+		// No more parameters, so everything left is literal
+		if open < 0 || end < 0 {
+			expression.WriteString(regexp.QuoteMeta(rest))
+			pattern.literal += len(rest)
+			break
+		}
+
+		expression.WriteString(regexp.QuoteMeta(rest[:open]))
+		expression.WriteString("([^/]+)")
+		pattern.literal += open
+		pattern.params = append(pattern.params, rest[open+1:open+end])
+		rest = rest[open+end+1:]
+
+	}
+	if pattern.wildcard {
+		expression.WriteString("(.*)")
+		pattern.params = append(pattern.params, WildcardParam)
+	}
+	expression.WriteString("$")
+
+	if len(pattern.params) == 0 {
+		return nil
+	}
+	pattern.expression = regexp.MustCompile(expression.String())
+	return pattern
+
+}
+
+// match checks a route against the pattern and returns the parameters if it matches.
+func (pattern *routePattern) match(route string) (map[string]string, bool) {
+
+	values := pattern.expression.FindStringSubmatch(route)
+	if values == nil {
+		return nil, false
+	}
+
+	params := make(map[string]string, len(pattern.params))
+	for i, name := range pattern.params {
+		params[name] = values[i+1]
+	}
+	return params, true
+
+}
+
+// before is true when this pattern should be tried before the other one.
+func (pattern *routePattern) before(other *routePattern) bool {
+	if pattern.wildcard != other.wildcard {
+		return !pattern.wildcard
+	}
+	if pattern.literal != other.literal {
+		return pattern.literal > other.literal
+	}
+	if len(pattern.params) != len(other.params) {
+		return len(pattern.params) < len(other.params)
+	}
+	return pattern.source < other.source
+}
+
+///////////////
+// NOT FOUND //
+///////////////
+
+// NotFound sets the handler used for requests which don't match any route. By default
+// 	(or if handler is nil) those requests are answered with an error.
+func (manager *Manager) NotFound(handler Handler) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.notFound = handler
+}
+
+// getNotFound returns the not found handler.
+func (manager *Manager) getNotFound() Handler {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	return manager.notFound
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// resolve finds the route which should handle a request, along with any parameters pulled
+// 	out of the route. It returns nil if nothing matches.
+func (manager *Manager) resolve(route string) (*routeRecord, map[string]string) {
+
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+
+	// Exact routes always win
+	if attached, ok := manager.routes[route]; ok && attached.pattern == nil {
+		return attached, nil
+	}
+
+	// Otherwise try the patterns in order of precedence
+	for _, attached := range manager.patterns {
+		if params, ok := attached.pattern.match(route); ok {
+			return attached, params
+		}
+	}
+
+	return nil, nil
+
+}
+
+// rebuildPatternsLocked rebuilds the sorted list of pattern routes. The stateLock must
+// 	already be held.
+func (manager *Manager) rebuildPatternsLocked() {
+
+	manager.patterns = manager.patterns[:0]
+	for _, attached := range manager.routes {
+		if attached.pattern != nil {
+			manager.patterns = append(manager.patterns, attached)
+		}
+	}
+	sort.Slice(manager.patterns, func(i, j int) bool {
+		return manager.patterns[i].pattern.before(manager.patterns[j].pattern)
+	})
+
+}
@@ -3,52 +3,79 @@
 package managers
 
 import (
-	"errors"
+	"context"
 	"sync"
 )
 
 /*
-NewManager will return a blank manager for use.
-Buffer size is the number of requests for the manager to hold onto until it starts blocking
-requests. The appropriate number will depend on how many requests you expect the manager
-to receive and how long each request takes to process.
+New will return a blank manager for use, configured by the options (see Option). Without
+any, the manager has a queue of DefaultBufferSize requests, prints its processing errors
+depending on LOG_PROCESSING_ERRORS, stops if an attached function panics, and is added to
+the DefaultRegistry.
+
+	manager, err := managers.New("Example Manager",
+		managers.WithBufferSize(1024),
+		managers.WithLogger(log.Default()),
+		managers.WithTimeout(5*time.Second),
+		managers.WithPanicPolicy(managers.PanicRecover),
+	)
 */
-func NewManager(name string, bufferSize int) (*Manager, error) {
+func New(name string, opts ...Option) (*Manager, error) {
+
+	options := managerOptions{bufferSize: DefaultBufferSize, registry: DefaultRegistry}
+	for _, option := range opts {
+		option(&options)
+	}
+	if options.queue == nil {
+		options.queue = NewChannelQueue(options.bufferSize)
+	}
+	if options.registry == nil {
+		options.registry = DefaultRegistry
+	}
 
 	// Create a pointer to a new manager for clients to use. The requests and functions
 	// 	will be prepopulated for the user.
 	newManager := &Manager{
 		Name:      name,
-		requests:  make(chan *Request, bufferSize),
-		running:   false,
-		functions: make(map[string]func(managerState any, request any) any),
+		queue:     options.queue,
+		control:   make(chan *Request, controlBufferSize),
+		lifecycle: LifecycleCreated,
+		hooks:     options.hooks,
+		routes:    make(map[string]*routeRecord),
+		options:   options,
 		stateLock: sync.Mutex{},
-	}
-
-	// Mutex management
-	managersLock.Lock()
-	defer managersLock.Unlock()
 
-	// Check that the manager name doesn't already exist. If it does, we
-	// 	will obviously return an error.
-	if _, exists := managersMap[name]; exists {
-		return nil, errors.New("Manager with name " + name + " already exists!")
+		lifecycleChanged: make(chan struct{}),
+		done:             make(chan struct{}),
 	}
 
-	// Add it to the managers map and return it
-	managersMap[name] = newManager
+	// Add it to the registry, unless the name is already taken there
+	if err := options.registry.add(newManager); err != nil {
+		return nil, err
+	}
 	return newManager, nil
 
 }
 
+/*
+NewManager will return a blank manager for use.
+Buffer size is the number of requests for the manager to hold onto until it starts blocking
+requests. The appropriate number will depend on how many requests you expect the manager
+to receive and how long each request takes to process. This is the same as New with
+WithBufferSize, and any other options are passed along.
+*/
+func NewManager(name string, bufferSize int, opts ...Option) (*Manager, error) {
+	return New(name, append([]Option{WithBufferSize(bufferSize)}, opts...)...)
+}
+
 // NewRequest will return a new request with the given Route and input Data.
-// 	The response channel will be appropriately generated as well. We default to
-// 	length 1 channel because that's all we really need.
+// 	The done channel and a unique request id will be appropriately generated as well.
 func NewRequest(route string, data any) *Request {
 	return &Request{
 		Route:    route,
 		Data:     data,
-		response: make(chan responseStruct, 1),
+		Metadata: Metadata{MetadataRequestID: newRequestID()},
+		done:     make(chan struct{}),
 	}
 }
 
@@ -64,7 +91,7 @@ func Send(managerName string, route string, data any) (*Request, error) {
 
 	// If the manager doesn't exist, respond with an error
 	if !ok {
-		return nil, errors.New(managerName + " manager is not created or has been deleted (occurred during public send).")
+		return nil, newError("send", managerName, route, ErrManagerNotFound)
 	}
 
 	// Send a job to the manager and return with no errors
@@ -80,7 +107,7 @@ func SendRequest(managerName string, request *Request) error {
 
 	// If the manager doesn't exist, respond with an error
 	if !ok {
-		return errors.New(managerName + " manager is not created or has been deleted (occurred during public sendRequest).")
+		return newRequestError("sendRequest", managerName, request, ErrManagerNotFound)
 	}
 
 	// Send a job to the manager and return with no errors
@@ -98,7 +125,7 @@ func Await(managerName string, route string, data any) (any, error) {
 
 	// If the manager doesn't exist, respond with an error
 	if !ok {
-		return nil, errors.New(managerName + " manager is not created or has been deleted (occurred during public await).")
+		return nil, newError("await", managerName, route, ErrManagerNotFound)
 	}
 
 	// Send a job to the manager and return with no errors
@@ -113,28 +140,60 @@ func AwaitRequest(managerName string, request *Request) (any, error) {
 
 	// If the manager doesn't exist, respond with an error
 	if !ok {
-		return nil, errors.New(managerName + " manager is not created or has been deleted (occurred during public sendRequest).")
+		return nil, newRequestError("awaitRequest", managerName, request, ErrManagerNotFound)
 	}
 
 	// Send a job to the manager and return with no errors
 	return manager.AwaitRequest(request)
 }
 
+// Binding for manager.SendContext() with the overhead of fetching manager by name.
+func SendContext(ctx context.Context, managerName string, route string, data any) (*Request, error) {
+
+	// Get the manager
+	manager, ok := getManager(managerName)
+
+	// If the manager doesn't exist, respond with an error
+	if !ok {
+		return nil, newError("send", managerName, route, ErrManagerNotFound)
+	}
+
+	// Send a job to the manager
+	return manager.SendContext(ctx, route, data)
+
+}
+
+// Binding for manager.AwaitContext() with the overhead of fetching manager by name.
+func AwaitContext(ctx context.Context, managerName string, route string, data any) (any, error) {
+
+	// Get the manager
+	manager, ok := getManager(managerName)
+
+	// If the manager doesn't exist, respond with an error
+	if !ok {
+		return nil, newError("await", managerName, route, ErrManagerNotFound)
+	}
+
+	// Send a job to the manager and wait for it
+	return manager.AwaitContext(ctx, route, data)
+
+}
+
 /////////////////////
 // MANAGER CONTROL //
 /////////////////////
 
 // Binding for manager.Attach() with the overhead of fetching manager by name.
-func Attach(managerName string, route string, f func(any, any) any) error {
+func Attach(managerName string, route string, f func(any, any) any, options ...RouteOption) error {
 
 	// First grab the manager
 	manager, exists := getManager(managerName)
 	if !exists {
-		return errors.New(managerName + " manager doesn't exist or has been deleted (occurred during public attach).")
+		return newError("attach", managerName, route, ErrManagerNotFound)
 	}
 
 	// Then attach the function
-	manager.Attach(route, f)
+	manager.Attach(route, f, options...)
 
 	// If here, nothing went wrong
 	return nil
@@ -147,7 +206,7 @@ func Detach(managerName string, route string) error {
 	// First grab the manager
 	manager, exists := getManager(managerName)
 	if !exists {
-		return errors.New(managerName + " manager doesn't exist or has been deleted (occurred during public attach).")
+		return newError("detach", managerName, route, ErrManagerNotFound)
 	}
 
 	// Then detach the route
@@ -158,6 +217,21 @@ func Detach(managerName string, route string) error {
 
 }
 
+// Binding for manager.Mount() with the overhead of fetching manager by name.
+func Mount(managerName string, prefix string, router *Router) error {
+
+	// First grab the manager
+	manager, exists := getManager(managerName)
+	if !exists {
+		return newError("mount", managerName, "", ErrManagerNotFound)
+	}
+
+	// Then mount the router
+	manager.Mount(prefix, router)
+	return nil
+
+}
+
 // Binding for manager.Start() with the overhead of fetching manager by name. The only
 // 	difference is that the manager will automatically start detached. (Non-blocking call)
 func Start(managerName string, managerState any) error {
@@ -165,7 +239,7 @@ func Start(managerName string, managerState any) error {
 	// First grab the manager
 	manager, exists := getManager(managerName)
 	if !exists {
-		return errors.New(managerName + " manager doesn't exist or has been deleted (occurred during start).")
+		return newError("start", managerName, "", ErrManagerNotFound)
 	}
 
 	// Then start the manager
@@ -184,7 +258,7 @@ func GetManager(managerName string) (*Manager, error) {
 	// First grab the manager
 	manager, exists := getManager(managerName)
 	if !exists {
-		return nil, errors.New(managerName + " manager doesn't exist or has been deleted (occurred during getManager).")
+		return nil, newError("get", managerName, "", ErrManagerNotFound)
 	}
 
 	return manager, nil
@@ -196,7 +270,7 @@ func Kill(managerName string) error {
 
 	manager, exists := getManager(managerName)
 	if !exists {
-		return errors.New(managerName + " manager doesn't exist or has been deleted (occurred during kil).")
+		return newError("kill", managerName, "", ErrManagerNotFound)
 	}
 
 	// Just send a kill request and wait for completion
@@ -209,7 +283,7 @@ func Remove(managerName string) error {
 
 	manager, exists := getManager(managerName)
 	if !exists {
-		return errors.New(managerName + " manager doesn't exist or has been deleted (occurred during remove).")
+		return newError("remove", managerName, "", ErrManagerNotFound)
 	}
 
 	return manager.Remove()
@@ -221,7 +295,7 @@ func KillAndRemove(managerName string) error {
 
 	manager, exists := getManager(managerName)
 	if !exists {
-		return errors.New(managerName + " manager doesn't exist or has been deleted (occurred during killAndRemove).")
+		return newError("killAndRemove", managerName, "", ErrManagerNotFound)
 	}
 
 	return manager.KillAndRemove()
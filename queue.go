@@ -0,0 +1,406 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"container/heap"
+	"context"
+	"strconv"
+	"sync"
+)
+
+///////////
+// QUEUE //
+///////////
+
+/*
+Queue holds the requests waiting for a manager. Every manager has one, which by default is a
+bounded channel queue the size of the buffer given to NewManager. A different queue can be
+given with the WithQueue option:
+
+	manager, err := managers.NewManager("Example Manager", 0, managers.WithQueue(managers.NewRingQueue()))
+
+The built in queues are NewChannelQueue (bounded, first in first out), NewRingQueue (unbounded,
+first in first out), NewPriorityQueue (highest priority first) and DiskQueue (unbounded, kept on
+disk until acknowledged, see OpenDiskQueue).
+
+A manager only ever dequeues from a single goroutine, but requests are enqueued from anywhere,
+so implementations must be safe to use from several goroutines at once. Internal requests (like
+the ones sent by Kill) go through the queue too, so a queue shouldn't drop or reorder requests
+unless that's the point of it.
+*/
+type Queue interface {
+
+	// Enqueue adds a request to the queue. It blocks while the queue is full, returning the
+	// 	context's error if it ends first, and returns ErrQueueClosed once the queue is closed.
+	Enqueue(ctx context.Context, request *Request) error
+
+	// Dequeue removes the next request from the queue, blocking until there is one. A request
+	// 	which is ready is returned even if the context has already ended. Otherwise it returns
+	// 	the context's error if it ends first, and ErrQueueClosed once the queue is closed and
+	// 	there is nothing left to dequeue.
+	Dequeue(ctx context.Context) (*Request, error)
+
+	// Len returns the number of requests in the queue, and Cap the most it can hold, or -1 if
+	// 	it has no limit.
+	Len() int
+	Cap() int
+
+	// Close stops the queue from accepting requests. Whatever is left can still be dequeued.
+	Close() error
+}
+
+///////////////////
+// CHANNEL QUEUE //
+///////////////////
+
+// channelQueue is a bounded queue on top of a buffered channel
+type channelQueue struct {
+	requests  chan *Request
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewChannelQueue returns a bounded first in first out queue which holds size requests. This
+// 	is the queue a manager uses by default. A size of zero means every Enqueue waits for the
+// 	manager to take the request.
+func NewChannelQueue(size int) Queue {
+	return &channelQueue{
+		requests: make(chan *Request, size),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Enqueue adds a request, blocking while the channel is full.
+func (queue *channelQueue) Enqueue(ctx context.Context, request *Request) error {
+
+	// Checked first, so a closed queue never accepts a request just because there's room
+	select {
+	case <-queue.closed:
+		return ErrQueueClosed
+	default:
+	}
+
+	select {
+	case queue.requests <- request:
+		return nil
+	case <-queue.closed:
+		return ErrQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+}
+
+// Dequeue removes the next request, blocking while the channel is empty.
+func (queue *channelQueue) Dequeue(ctx context.Context) (*Request, error) {
+
+	select {
+	case request := <-queue.requests:
+		return request, nil
+	default:
+	}
+
+	select {
+	case request := <-queue.requests:
+		return request, nil
+	case <-queue.closed:
+		select {
+		case request := <-queue.requests:
+			return request, nil
+		default:
+			return nil, ErrQueueClosed
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+}
+
+// Len returns the number of requests in the channel.
+func (queue *channelQueue) Len() int {
+	return len(queue.requests)
+}
+
+// Cap returns the size of the channel.
+func (queue *channelQueue) Cap() int {
+	return cap(queue.requests)
+}
+
+// Close stops the queue from accepting requests.
+func (queue *channelQueue) Close() error {
+	queue.closeOnce.Do(func() { close(queue.closed) })
+	return nil
+}
+
+////////////////
+// RING QUEUE //
+////////////////
+
+// NewRingQueue returns an unbounded first in first out queue. Enqueue never blocks, the
+// 	ring buffer just grows to fit.
+func NewRingQueue() Queue {
+	return newBufferedQueue(&ringBuffer{}, -1)
+}
+
+// ringBuffer is a growable ring of requests
+type ringBuffer struct {
+	requests []*Request
+	head     int
+	count    int
+}
+
+// push adds a request at the back, doubling the ring if it's full.
+func (ring *ringBuffer) push(request *Request) {
+	if ring.count == len(ring.requests) {
+		grown := make([]*Request, 2*len(ring.requests)+1)
+		for i := 0; i < ring.count; i++ {
+			grown[i] = ring.requests[(ring.head+i)%len(ring.requests)]
+		}
+		ring.requests, ring.head = grown, 0
+	}
+	ring.requests[(ring.head+ring.count)%len(ring.requests)] = request
+	ring.count++
+}
+
+// pop removes the request at the front.
+func (ring *ringBuffer) pop() *Request {
+	request := ring.requests[ring.head]
+	ring.requests[ring.head] = nil
+	ring.head = (ring.head + 1) % len(ring.requests)
+	ring.count--
+	return request
+}
+
+// size returns the number of requests in the ring.
+func (ring *ringBuffer) size() int {
+	return ring.count
+}
+
+////////////////////
+// PRIORITY QUEUE //
+////////////////////
+
+// NewPriorityQueue returns a queue which hands out the request with the highest priority
+// 	first, and requests with the same priority first in first out. Priority returns the
+// 	priority of a request. If it's nil, the request's MetadataPriority is used (see
+// 	Request.Priority). A capacity of zero or less means the queue has no limit, otherwise
+// 	Enqueue blocks while it's full.
+func NewPriorityQueue(capacity int, priority func(request *Request) int) Queue {
+	if priority == nil {
+		priority = (*Request).Priority
+	}
+	if capacity <= 0 {
+		capacity = -1
+	}
+	return newBufferedQueue(&priorityHeap{priority: priority}, capacity)
+}
+
+// Priority returns the request's MetadataPriority as a number, or zero if it isn't set.
+func (request *Request) Priority() int {
+	priority, _ := strconv.Atoi(request.Metadata.Get(MetadataPriority))
+	return priority
+}
+
+// priorityHeap is a heap of requests, highest priority first
+type priorityHeap struct {
+	priority func(request *Request) int
+	entries  []priorityEntry
+	sequence uint64
+}
+
+// priorityEntry is a request in the heap. The sequence breaks ties so equal priorities
+// 	stay in order.
+type priorityEntry struct {
+	request  *Request
+	priority int
+	sequence uint64
+}
+
+// push adds a request to the heap.
+func (queue *priorityHeap) push(request *Request) {
+	queue.sequence++
+	heap.Push(queue, priorityEntry{request: request, priority: queue.priority(request), sequence: queue.sequence})
+}
+
+// pop removes the request with the highest priority.
+func (queue *priorityHeap) pop() *Request {
+	return heap.Pop(queue).(priorityEntry).request
+}
+
+// size returns the number of requests in the heap.
+func (queue *priorityHeap) size() int {
+	return len(queue.entries)
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface.
+func (queue *priorityHeap) Len() int { return len(queue.entries) }
+
+func (queue *priorityHeap) Less(i, j int) bool {
+	if queue.entries[i].priority != queue.entries[j].priority {
+		return queue.entries[i].priority > queue.entries[j].priority
+	}
+	return queue.entries[i].sequence < queue.entries[j].sequence
+}
+
+func (queue *priorityHeap) Swap(i, j int) {
+	queue.entries[i], queue.entries[j] = queue.entries[j], queue.entries[i]
+}
+
+func (queue *priorityHeap) Push(entry any) {
+	queue.entries = append(queue.entries, entry.(priorityEntry))
+}
+
+func (queue *priorityHeap) Pop() any {
+	last := queue.entries[len(queue.entries)-1]
+	queue.entries[len(queue.entries)-1] = priorityEntry{}
+	queue.entries = queue.entries[:len(queue.entries)-1]
+	return last
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// requestBuffer is the storage behind a buffered queue, which decides the order requests
+// 	come out in
+type requestBuffer interface {
+	push(request *Request)
+	pop() *Request
+	size() int
+}
+
+// bufferedQueue implements Queue on top of any request buffer, with a lock and a pair of
+// 	signal channels for waking up whoever is waiting on the queue.
+type bufferedQueue struct {
+	lock     sync.Mutex
+	buffer   requestBuffer
+	capacity int
+	closed   bool
+
+	// Ready and space are signalled (without blocking) whenever a request is added and
+	// 	removed. Done is closed when the queue is closed.
+	ready chan struct{}
+	space chan struct{}
+	done  chan struct{}
+}
+
+// newBufferedQueue returns an empty queue using the buffer. A capacity of -1 means no limit.
+func newBufferedQueue(buffer requestBuffer, capacity int) *bufferedQueue {
+	return &bufferedQueue{
+		buffer:   buffer,
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Enqueue adds a request, blocking while the queue is full.
+func (queue *bufferedQueue) Enqueue(ctx context.Context, request *Request) error {
+
+	for {
+		queue.lock.Lock()
+		if queue.closed {
+			queue.lock.Unlock()
+			return ErrQueueClosed
+		}
+		if queue.capacity < 0 || queue.buffer.size() < queue.capacity {
+			queue.buffer.push(request)
+			more := queue.capacity < 0 || queue.buffer.size() < queue.capacity
+			queue.lock.Unlock()
+
+			// Pass the signal on in case someone else is waiting as well
+			signal(queue.ready)
+			if more {
+				signal(queue.space)
+			}
+			return nil
+		}
+		queue.lock.Unlock()
+
+		select {
+		case <-queue.space:
+		case <-queue.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+}
+
+// Dequeue removes the next request, blocking while the queue is empty.
+func (queue *bufferedQueue) Dequeue(ctx context.Context) (*Request, error) {
+
+	for {
+		queue.lock.Lock()
+		if queue.buffer.size() > 0 {
+			request := queue.buffer.pop()
+			more := queue.buffer.size() > 0
+			queue.lock.Unlock()
+
+			// Pass the signal on in case someone else is waiting as well
+			signal(queue.space)
+			if more {
+				signal(queue.ready)
+			}
+			return request, nil
+		}
+		if queue.closed {
+			queue.lock.Unlock()
+			return nil, ErrQueueClosed
+		}
+		queue.lock.Unlock()
+
+		select {
+		case <-queue.ready:
+		case <-queue.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+}
+
+// Len returns the number of requests in the queue.
+func (queue *bufferedQueue) Len() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.buffer.size()
+}
+
+// Cap returns the capacity of the queue, or -1 if it has no limit.
+func (queue *bufferedQueue) Cap() int {
+	return queue.capacity
+}
+
+// Close stops the queue from accepting requests and wakes up everyone waiting on it.
+func (queue *bufferedQueue) Close() error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if !queue.closed {
+		queue.closed = true
+		close(queue.done)
+	}
+	return nil
+}
+
+// clear removes every request from the queue, returning them.
+func (queue *bufferedQueue) clear() []*Request {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	requests := make([]*Request, 0, queue.buffer.size())
+	for queue.buffer.size() > 0 {
+		requests = append(requests, queue.buffer.pop())
+	}
+	signal(queue.space)
+	return requests
+}
+
+// signal wakes up whoever is waiting on the channel, without blocking if nobody is.
+func signal(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
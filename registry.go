@@ -0,0 +1,88 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"sort"
+	"sync"
+)
+
+//////////////
+// REGISTRY //
+//////////////
+
+// Registry maps names to managers, so managers can be found without holding onto their
+// 	handles. Every manager is added to a registry when it is created, which is the
+// 	DefaultRegistry unless it was created with WithRegistry. Names only need to be
+// 	unique within a registry.
+type Registry struct {
+	lock     *sync.Mutex
+	managers map[string]*Manager
+}
+
+// DefaultRegistry is the registry the public functions (Send, Await, GetManager, List and
+// 	the rest) look managers up in.
+var DefaultRegistry = &Registry{lock: &managersLock, managers: managersMap}
+
+// NewRegistry returns an empty registry. Managers in it can't be reached through the
+// 	public functions, which is handy for keeping tests or separate subsystems apart.
+func NewRegistry() *Registry {
+	return &Registry{lock: &sync.Mutex{}, managers: make(map[string]*Manager)}
+}
+
+// Get returns the manager with the given name.
+func (registry *Registry) Get(name string) (*Manager, error) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	manager, ok := registry.managers[name]
+	if !ok {
+		return nil, newError("get", name, "", ErrManagerNotFound)
+	}
+	return manager, nil
+}
+
+// List returns the info for every manager in the registry, sorted by manager name.
+func (registry *Registry) List() []ManagerInfo {
+
+	// Copy the managers out first so we aren't holding the registry lock while we
+	// 	wait on each of the manager locks.
+	registry.lock.Lock()
+	handles := make([]*Manager, 0, len(registry.managers))
+	for _, manager := range registry.managers {
+		handles = append(handles, manager)
+	}
+	registry.lock.Unlock()
+
+	infos := make([]ManagerInfo, 0, len(handles))
+	for _, manager := range handles {
+		infos = append(infos, manager.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// add puts a manager in the registry, unless its name is taken.
+func (registry *Registry) add(manager *Manager) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, exists := registry.managers[manager.Name]; exists {
+		return newError("create", manager.Name, "", ErrManagerExists)
+	}
+	registry.managers[manager.Name] = manager
+	return nil
+}
+
+// remove takes the manager with the given name out of the registry.
+func (registry *Registry) remove(name string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	delete(registry.managers, name)
+}
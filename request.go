@@ -3,7 +3,9 @@
 package managers
 
 import (
-	"errors"
+	"context"
+	"sync"
+	"time"
 )
 
 // Request is the generic type used to communicate information to and from managers.
@@ -17,10 +19,52 @@ type Request struct {
 	// Data is the information being transferred during the request.
 	Data any
 
-	// Response is what is sent back when the process is finished
-	// Response is a channel so that await commands can wait for the process
-	// 	thread to finish it's computations. This is not necessary for a user to see.
-	response chan responseStruct
+	// Metadata carries headers along with the request, like its unique id, the caller and
+	// 	the tenant. Handlers and middleware can read it through the request. See metadata.go.
+	Metadata Metadata
+
+	// Params are the values pulled out of the route when it matched a pattern route
+	// 	(like "account/{id}/balance"). This is set by the manager before processing.
+	Params map[string]string
+
+	// Ctx is the context the request was sent with (see Manager.SendContext), and span is
+	// 	the trace span of the attached function while the request is processed. QueuedAt
+	// 	is when the request was sent, used to time the queue wait.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	span     SpanContext
+	queuedAt time.Time
+
+	// Attempts is the number of times the request has already been tried. See retry.go.
+	attempts int
+
+	// The disk queue the request was written to and its sequence number there, until the
+	// 	request is acknowledged. See disk.go.
+	disk     *DiskQueue
+	sequence uint64
+
+	// The half open circuit breakers which let the request through as a trial, until the
+	// 	request either reaches its route or is answered without it. See circuit.go.
+	trials []circuitTrial
+
+	// The circuit breakers still to hear how the request went, once its route was called.
+	// 	This outlives the call when the route returns a Deferred. See circuit.go.
+	pending *circuitPending
+
+	// Continuation is set when a Deferred sends the request back to the manager to finish
+	// 	processing. See deferred.go.
+	continuation func(managerState any) any
+
+	// Response is what is sent back when the process is finished. Done is closed once
+	// 	the response is stored so that await commands can wait for the process thread
+	// 	to finish it's computations. Only the first response is ever stored, so the
+	// 	response can be read as many times as needed. This is not necessary for a user to see.
+	response     responseStruct
+	responseOnce sync.Once
+	done         chan struct{}
+	resultOnce   sync.Once
+	resultData   any
+	resultError  error
 }
 
 // responseStruct is the default type returned by objects
@@ -41,7 +85,7 @@ func (request *Request) Send(managerName string) error {
 
 	// If the manager doesn't exist, respond with an error
 	if !ok {
-		return errors.New(managerName + " manager is not created or has been deleted (occurred during request send).")
+		return newRequestError("send", managerName, request, ErrManagerNotFound)
 	}
 
 	// Otherwise, send the request to the manager and return with no errors
@@ -58,7 +102,7 @@ func (request *Request) Await(managerName string) (any, error) {
 
 	// If the manager doesn't exist, respond with an error
 	if !ok {
-		return nil, errors.New(managerName + " manager is not created or has been deleted (occurred during request send).")
+		return nil, newRequestError("await", managerName, request, ErrManagerNotFound)
 	}
 
 	// Call the binding
@@ -86,25 +130,81 @@ func (request *Request) AwaitManager(manager *Manager) (any, error) {
 // 	Once the response is given, the data will be parsed and returned.
 func (request *Request) Wait() (any, error) {
 
-	// Just wait for data to be put in the response
-	response := <-request.response
-	return response.getData()
+	// Just wait for data to be put in the response. The data is only parsed once so
+	// 	that Wait can be called as many times as you like.
+	<-request.done
+	request.resultOnce.Do(func() {
+		request.resultData, request.resultError = request.response.getData()
+	})
+	return request.resultData, request.resultError
 
 }
 
-// Check to see if the request has been carried out yet. As long as there are responses,
+// Context returns the context the request was sent with, or context.Background() if it was
+// 	sent without one. While an attached function is running, the context also carries the
+// 	trace span for the function, so sending further requests with it links them into the
+// 	same trace. It should only be called from inside the attached function (or after the
+// 	request has a response).
+func (request *Request) Context() context.Context {
+	ctx := request.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if request.span.SpanID != "" {
+		ctx = ContextWithSpan(ctx, request.span)
+	}
+	return ctx
+}
+
+// Param returns a single value pulled out of the route by a pattern route. It is empty if
+// 	the parameter doesn't exist.
+func (request *Request) Param(name string) string {
+	return request.Params[name]
+}
+
+// Stream waits for the request to be processed and returns the stream the route responded
+// 	with. If the route responded with a plain value instead, that value is returned as a
+// 	stream with a single item.
+func (request *Request) Stream() (*Stream, error) {
+
+	data, err := request.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	if stream, ok := data.(*Stream); ok {
+		return stream, nil
+	}
+	return streamOf(data), nil
+
+}
+
+// Check to see if the request has been carried out yet. Once there is a response,
 // 	the request "has data"
 func (request *Request) HasData() bool {
-	return len(request.response) > 0
+	select {
+	case <-request.done:
+		return true
+	default:
+		return false
+	}
 }
 
 ////////////////////////
 // INTERNAL FUNCTIONS //
 ////////////////////////
 
-// Internal function for storing a response
+// Internal function for storing a response. Only the first response is kept. Streams are
+// 	still being filled when they're stored, so their context is cancelled once they finish
+// 	instead (see Stream.run).
 func (request *Request) storeResponse(response responseStruct) {
-	request.response <- response
+	request.responseOnce.Do(func() {
+		request.response = response
+		close(request.done)
+		if _, streaming := response.Data.(*Stream); !streaming && request.cancel != nil {
+			request.cancel()
+		}
+	})
 }
 
 /*
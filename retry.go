@@ -0,0 +1,297 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+//////////////////
+// RETRY POLICY //
+//////////////////
+
+/*
+RetryPolicy describes how a failed request is tried again. Only errors marked with Retryable
+are retried. Everything else (including route not found, validation and authorization errors)
+fails straight away.
+
+The wait before retry n (counting from 1) is InitialBackoff * Multiplier^(n-1), capped at
+MaxBackoff. Jitter shortens each wait by a random fraction up to Jitter (0.2 waits between 80%
+and 100% of the backoff), so many callers failing at once don't all retry at once.
+
+A policy can be used from the sending side with Manager.AwaitRetry, or given to a route with the
+Retry route option, in which case the manager retries the request itself and the caller just
+sees the final result. Either way, every attempt counts against the manager's retry budget (see
+SetRetryBudget) and shows up in Info() and in tracing through the "request.attempt" attribute.
+*/
+type RetryPolicy struct {
+
+	// MaxAttempts is the total number of attempts, including the first. Anything less
+	// 	than 2 means the request is never retried.
+	MaxAttempts int
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Multiplier grows the backoff after each attempt. Zero means 2.
+	Multiplier float64
+
+	// Jitter is the largest fraction (between 0 and 1) taken off of each backoff at random
+	Jitter float64
+}
+
+// Retry annotates a route with a retry policy. When the route returns a retryable error, the
+// 	manager queues the request again after the backoff rather than answering it, so the
+// 	processing loop is never held up waiting. Requests which returned a Stream or Deferred
+// 	are never retried.
+func Retry(policy RetryPolicy) RouteOption {
+	return func(options *routeOptions) {
+		options.retry = &policy
+	}
+}
+
+// Retryable marks an error as worth retrying. Attached functions return it to let a retry
+// 	policy know the failure is temporary.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// IsRetryable returns whether an error (or anything it wraps) was marked with Retryable, or
+// 	has a Retryable() method which returns true.
+func IsRetryable(err error) bool {
+	var marked interface{ Retryable() bool }
+	return errors.As(err, &marked) && marked.Retryable()
+}
+
+// Attempt returns which attempt this is at the request, starting from 1.
+func (request *Request) Attempt() int {
+	return request.attempts + 1
+}
+
+// AwaitRetry sends a request and waits for it like AwaitContext, sending it again as the
+// 	policy allows whenever it fails with a retryable error. Every attempt carries the same
+// 	metadata (and so the same request id). The last error is returned if the attempts or the
+// 	retry budget run out, and the context's error if it ends while waiting.
+func (manager *Manager) AwaitRetry(ctx context.Context, policy RetryPolicy, route string, data any) (any, error) {
+
+	var metadata Metadata
+	for attempt := 0; ; attempt++ {
+
+		request := NewRequest(route, data)
+		if metadata != nil {
+			request.Metadata = metadata.Clone()
+		}
+		metadata = request.Metadata
+		request.attempts = attempt
+
+		if err := manager.sendContext(ctx, request); err != nil {
+			return nil, err
+		}
+		result, err := manager.waitContext(ctx, request)
+		if err == nil || !IsRetryable(err) || attempt+1 >= policy.MaxAttempts {
+			return result, err
+		}
+		attached, _ := manager.resolve(route)
+		if !manager.allowRetry(attached) {
+			return result, err
+		}
+
+		select {
+		case <-time.After(policy.backoff(attempt + 1)):
+		case <-ctx.Done():
+			return nil, newRequestError("await", manager.Name, request, ctx.Err())
+		}
+
+	}
+
+}
+
+// SetRetryBudget limits the manager to at most the given number of retries per period, on
+// 	both the sending and the manager side. The budget refills smoothly over the period. Once
+// 	it's spent, failures are returned instead of retried, which stops retries from piling
+// 	onto a manager which is already struggling. A period of zero removes the budget.
+func (manager *Manager) SetRetryBudget(retries int, period time.Duration) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	if period <= 0 {
+		manager.retryBudget = nil
+		return
+	}
+	manager.retryBudget = &retryBudget{
+		capacity: float64(retries),
+		tokens:   float64(retries),
+		rate:     float64(retries) / period.Seconds(),
+		last:     time.Now(),
+	}
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// retryableError is the error returned by Retryable
+type retryableError struct {
+	err error
+}
+
+// Error returns the message of the original error.
+func (err *retryableError) Error() string {
+	return err.err.Error()
+}
+
+// Unwrap returns the original error.
+func (err *retryableError) Unwrap() error {
+	return err.err
+}
+
+// Retryable marks the error as retryable.
+func (err *retryableError) Retryable() bool {
+	return true
+}
+
+// retryBudget is a token bucket of retries
+type retryBudget struct {
+	capacity float64
+	tokens   float64
+	rate     float64
+	last     time.Time
+}
+
+// take refills the bucket and takes a token if there is one.
+func (budget *retryBudget) take(now time.Time) bool {
+	budget.tokens = math.Min(budget.capacity, budget.tokens+now.Sub(budget.last).Seconds()*budget.rate)
+	budget.last = now
+	if budget.tokens < 1 {
+		return false
+	}
+	budget.tokens--
+	return true
+}
+
+// backoff returns how long to wait before the given retry (counting from 1).
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+
+	multiplier := policy.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	backoff := float64(policy.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if policy.MaxBackoff > 0 {
+		backoff = math.Min(backoff, float64(policy.MaxBackoff))
+	}
+	if policy.Jitter > 0 {
+		backoff -= backoff * math.Min(policy.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(backoff)
+
+}
+
+// allowRetry spends a retry from the budget and counts it. Attached is the route being
+// 	retried, if it's known.
+func (manager *Manager) allowRetry(attached *routeRecord) bool {
+
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+
+	if manager.retryBudget != nil && !manager.retryBudget.take(time.Now()) {
+		manager.retriesRefused++
+		return false
+	}
+	manager.retries++
+	if attached != nil {
+		attached.retries++
+	}
+	return true
+
+}
+
+// retryLater is called by the processing loop when a route fails. If the route's policy
+// 	allows it, the request is queued again after the backoff and true is returned, so the
+// 	loop doesn't answer the request. The request is queued from a timer so the loop is never
+// 	held up. If the manager stops in the meantime, the loop fails the request with the
+// 	error as it stops (see stopRetries).
+func (manager *Manager) retryLater(request *Request, attached *routeRecord, err error) bool {
+
+	if attached == nil || attached.options.retry == nil || !IsRetryable(err) {
+		return false
+	}
+	policy := attached.options.retry
+	if request.attempts+1 >= policy.MaxAttempts || !manager.allowRetry(attached) {
+		return false
+	}
+
+	request.attempts++
+	manager.stateLock.Lock()
+	if manager.retrying == nil {
+		manager.retrying = make(map[*Request]error)
+	}
+	manager.retrying[request] = err
+	manager.stateLock.Unlock()
+
+	time.AfterFunc(policy.backoff(request.attempts), func() {
+		manager.resend(request)
+	})
+	return true
+
+}
+
+// resend queues a retry again once its backoff is over. Retries are only queued while the
+// 	run which scheduled them is still going. Otherwise, or if queueing fails, the retry is
+// 	left for stopRetries to fail.
+func (manager *Manager) resend(request *Request) {
+
+	manager.stateLock.Lock()
+	err, pending := manager.retrying[request]
+	if !pending || !manager.lifecycle.active() {
+		manager.stateLock.Unlock()
+		return
+	}
+	delete(manager.retrying, request)
+	ctx := manager.runContext
+	manager.retrySends.Add(1)
+	manager.stateLock.Unlock()
+	defer manager.retrySends.Done()
+
+	request.queuedAt = time.Now()
+	if manager.queue.Enqueue(ctx, request) != nil {
+		manager.stateLock.Lock()
+		manager.retrying[request] = err
+		manager.stateLock.Unlock()
+	}
+
+}
+
+// stopRetries is called by the processing loop as it stops. Retries which haven't been
+// 	queued again are failed with the error which caused them, just like any other failed
+// 	request. Retries which were queued are left for rejectQueued, so this must be called
+// 	before it.
+func (manager *Manager) stopRetries(managerState any) {
+
+	// Stop anything still being queued, and wait for it to land one way or the other
+	manager.stateLock.Lock()
+	cancel := manager.runCancel
+	manager.stateLock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	manager.retrySends.Wait()
+
+	manager.stateLock.Lock()
+	pending := manager.retrying
+	manager.retrying = nil
+	manager.stateLock.Unlock()
+
+	for request, err := range pending {
+		manager.reportFailure(managerState, request, err)
+		manager.acknowledge(request)
+		request.storeResponse(responseStruct{Error: err})
+	}
+
+}
@@ -0,0 +1,252 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"sort"
+	"strings"
+)
+
+// Handler is a processing function which receives the whole request rather than just its
+// 	data. Anything attached with Attach is wrapped into a Handler internally.
+type Handler func(managerState any, request *Request) any
+
+// Middleware wraps a handler with some shared behavior (logging, validation, etc.). The
+// 	middleware runs inside the processing goroutine, so it can safely use the state.
+type Middleware func(next Handler) Handler
+
+// RouteOption annotates a route when it is attached, like the permissions needed to call
+// 	it. Options are passed as the last arguments to any of the Attach functions.
+type RouteOption func(options *routeOptions)
+
+// routeOptions is everything a route can be annotated with
+type routeOptions struct {
+
+	// Permissions needed to call the route, and whether it skips authorization entirely.
+	// 	See authorization.go.
+	permissions []string
+	public      bool
+
+	// Validator for the request data. See validation.go.
+	input Validator
+
+	// Retry policy for failures. See retry.go.
+	retry *RetryPolicy
+
+	// Circuit breaker policy for the route. See circuit.go.
+	circuit *CircuitPolicy
+
+	// Whether the route changes the state. See snapshot.go.
+	write bool
+}
+
+// RouteSeparator is placed between a group prefix and the routes inside of it.
+const RouteSeparator = "."
+
+////////////
+// ROUTER //
+////////////
+
+// Router is a reusable collection of routes and middleware which isn't tied to any
+// 	manager. Build it once and mount it on as many managers as you'd like. Routers are
+// 	not safe to modify from several goroutines at once, build them up front.
+type Router struct {
+	routes     []routerRoute
+	middleware []Middleware
+}
+
+// routerRoute is a single route inside of a router. The handler already includes the
+// 	middleware from any routers mounted inside this one.
+type routerRoute struct {
+	route   string
+	handler Handler
+	options []RouteOption
+}
+
+// NewRouter returns an empty router using the given middleware.
+func NewRouter(middleware ...Middleware) *Router {
+	return &Router{
+		middleware: append([]Middleware{}, middleware...),
+	}
+}
+
+// Use adds middleware to the router. The router's middleware is applied when it is
+// 	mounted, so it covers every route in the router no matter when they were added.
+func (router *Router) Use(middleware ...Middleware) *Router {
+	router.middleware = append(router.middleware, middleware...)
+	return router
+}
+
+// Attach adds a function to the router at the given route.
+func (router *Router) Attach(route string, function func(managerState any, request any) any, options ...RouteOption) *Router {
+	return router.AttachHandler(route, dataHandler(function), options...)
+}
+
+// AttachHandler adds a handler to the router at the given route.
+func (router *Router) AttachHandler(route string, handler Handler, options ...RouteOption) *Router {
+	router.routes = append(router.routes, routerRoute{route: route, handler: handler, options: options})
+	return router
+}
+
+// Mount nests another router inside of this one under the given prefix.
+func (router *Router) Mount(prefix string, other *Router) *Router {
+	router.routes = append(router.routes, other.compile(prefix, nil)...)
+	return router
+}
+
+// Routes returns the names of every route in the router, sorted.
+func (router *Router) Routes() []string {
+	routes := make([]string, 0, len(router.routes))
+	for _, attached := range router.routes {
+		routes = append(routes, attached.route)
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// compile returns every route in the router with the prefix added, wrapped in the router's
+// 	middleware and then any outer middleware.
+func (router *Router) compile(prefix string, outer []Middleware) []routerRoute {
+	middleware := append(append([]Middleware{}, outer...), router.middleware...)
+	compiled := make([]routerRoute, 0, len(router.routes))
+	for _, attached := range router.routes {
+		compiled = append(compiled, routerRoute{
+			route:   joinRoute(prefix, attached.route),
+			handler: wrapHandler(attached.handler, middleware),
+			options: attached.options,
+		})
+	}
+	return compiled
+}
+
+///////////
+// GROUP //
+///////////
+
+// Group is a view onto a manager which adds a prefix and a middleware stack to every
+// 	route attached through it. Groups can be nested.
+type Group struct {
+	manager    *Manager
+	prefix     string
+	middleware []Middleware
+}
+
+// Group returns a group which attaches routes on this manager under the given prefix.
+// 	With a prefix of "user", attaching "get" creates the route "user.get".
+func (manager *Manager) Group(prefix string, middleware ...Middleware) *Group {
+	return &Group{
+		manager:    manager,
+		prefix:     prefix,
+		middleware: append([]Middleware{}, middleware...),
+	}
+}
+
+// Group returns a nested group. The nested group shares this group's middleware.
+func (group *Group) Group(prefix string, middleware ...Middleware) *Group {
+	return &Group{
+		manager:    group.manager,
+		prefix:     joinRoute(group.prefix, prefix),
+		middleware: append(append([]Middleware{}, group.middleware...), middleware...),
+	}
+}
+
+// Use adds middleware to the group. Middleware is applied when a route is attached, so
+// 	only routes attached afterwards will use it.
+func (group *Group) Use(middleware ...Middleware) *Group {
+	group.middleware = append(group.middleware, middleware...)
+	return group
+}
+
+// Prefix returns the full prefix of the group.
+func (group *Group) Prefix() string {
+	return group.prefix
+}
+
+// Attach will attach a function to the group's manager under the group's prefix.
+func (group *Group) Attach(route string, function func(managerState any, request any) any, options ...RouteOption) {
+	group.AttachHandler(route, dataHandler(function), options...)
+}
+
+// AttachHandler will attach a handler to the group's manager under the group's prefix.
+func (group *Group) AttachHandler(route string, handler Handler, options ...RouteOption) {
+	group.manager.AttachHandler(joinRoute(group.prefix, route), wrapHandler(handler, group.middleware), options...)
+}
+
+// Mount attaches every route in a router under the group's prefix.
+func (group *Group) Mount(prefix string, router *Router) {
+	group.manager.attachAll(router.compile(joinRoute(group.prefix, prefix), group.middleware))
+}
+
+// Detach will remove a single route from the group.
+func (group *Group) Detach(route string) {
+	group.manager.Detach(joinRoute(group.prefix, route))
+}
+
+// DetachAll removes every route under the group's prefix, including nested groups.
+func (group *Group) DetachAll() {
+	group.manager.DetachGroup(group.prefix)
+}
+
+/////////////////////
+// MANAGER BINDING //
+/////////////////////
+
+// Mount attaches every route in a router to the manager under the given prefix. All of the
+// 	routes are attached at once, so a request can never see only half of the router.
+func (manager *Manager) Mount(prefix string, router *Router) {
+	manager.attachAll(router.compile(prefix, nil))
+}
+
+// DetachGroup removes every route under the given prefix at once.
+func (manager *Manager) DetachGroup(prefix string) {
+
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+
+	for route := range manager.routes {
+		if route == prefix || strings.HasPrefix(route, prefix+RouteSeparator) {
+			delete(manager.routes, route)
+		}
+	}
+	manager.rebuildPatternsLocked()
+
+}
+
+// attachAll attaches a set of routes while holding the lock the whole time.
+func (manager *Manager) attachAll(routes []routerRoute) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	for _, attached := range routes {
+		manager.attachLocked(attached.route, attached.handler, attached.options)
+	}
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// dataHandler turns a plain manager function into a handler.
+func dataHandler(function func(managerState any, request any) any) Handler {
+	return func(managerState any, request *Request) any {
+		return function(managerState, request.Data)
+	}
+}
+
+// wrapHandler applies middleware to a handler. The first middleware is the outermost.
+func wrapHandler(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// joinRoute puts a prefix and a route together with the route separator.
+func joinRoute(prefix string, route string) string {
+	if prefix == "" {
+		return route
+	}
+	if route == "" {
+		return prefix
+	}
+	return prefix + RouteSeparator + route
+}
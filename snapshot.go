@@ -0,0 +1,109 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"time"
+)
+
+//////////////
+// SNAPSHOT //
+//////////////
+
+// Snapshot is a copy of a manager's state, published so it can be read from outside the
+// 	processing goroutine. Version goes up by one with every snapshot the manager publishes,
+// 	so readers can tell whether anything changed. StateVersion is the version of the state
+// 	when the snapshot was published (see Manager.Version), which is what conditional
+// 	requests expect (see Request.IfVersion). The zero Snapshot means nothing has been
+// 	published yet.
+type Snapshot struct {
+	Version      uint64
+	StateVersion uint64
+	State        any
+	Published    time.Time
+}
+
+/*
+Publish makes a snapshot of the state available to Read. It is meant to be called from inside
+an attached function, once the state has been changed:
+
+	manager.Attach("deposit", func(managerState any, request any) any {
+		account := managerState.(*Account)
+		account.Balance += request.(int)
+		manager.Publish(*account)
+		return account.Balance
+	})
+
+Whatever is published is shared with every reader without any locking, so it must never be
+changed afterwards. Publish a copy (like the dereferenced struct above), never the live state.
+*/
+func (manager *Manager) Publish(state any) Snapshot {
+
+	manager.snapshotLock.Lock()
+	defer manager.snapshotLock.Unlock()
+
+	snapshot := &Snapshot{
+		Version:      manager.Read().Version + 1,
+		StateVersion: manager.Version(),
+		State:        state,
+		Published:    time.Now(),
+	}
+	manager.snapshot.Store(snapshot)
+	return *snapshot
+
+}
+
+// Read returns the most recently published snapshot. It never waits on the manager, so it can
+// 	be called as often as needed from any goroutine, even while the manager is busy.
+func (manager *Manager) Read() Snapshot {
+	if snapshot, ok := manager.snapshot.Load().(*Snapshot); ok {
+		return *snapshot
+	}
+	return Snapshot{}
+}
+
+// ReadAs returns the state of the manager's most recent snapshot as a T, along with the
+// 	version of the state it was taken from (the snapshot's StateVersion), ready to be used
+// 	with Request.IfVersion. It returns false if nothing has been published, or if the
+// 	snapshot isn't a T.
+func ReadAs[T any](manager *Manager) (T, uint64, bool) {
+	snapshot := manager.Read()
+	state, ok := snapshot.State.(T)
+	return state, snapshot.StateVersion, ok
+}
+
+// Write annotates a route which changes the state. Every time a write route succeeds, the
+// 	state moves on to the next version (see Manager.Version), and when the manager has a
+// 	snapshot function (see SetSnapshot), a snapshot is published. A write which returns a
+// 	Deferred only succeeds once its continuation does, and never if it's completed or
+// 	failed without one.
+func Write() RouteOption {
+	return func(options *routeOptions) {
+		options.write = true
+	}
+}
+
+// SetSnapshot publishes snapshots automatically. The function is given the state and returns
+// 	the copy to publish. It runs inside the processing goroutine after every write route which
+// 	succeeds, when the manager starts and when it's restarted. Setting nil stops publishing
+// 	automatically. Snapshots published so far can still be read.
+func (manager *Manager) SetSnapshot(copyState func(managerState any) any) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.snapshotCopy = copyState
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// publishState publishes a snapshot of the state, if the manager has a snapshot function.
+// 	This is always called from inside the processing goroutine.
+func (manager *Manager) publishState(managerState any) {
+	manager.stateLock.Lock()
+	copyState := manager.snapshotCopy
+	manager.stateLock.Unlock()
+	if copyState != nil {
+		manager.Publish(copyState(managerState))
+	}
+}
@@ -0,0 +1,182 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrStreamCancelled is returned from a stream's send function once the consumer has
+// 	cancelled the stream. Producers should stop and return when they see it.
+var ErrStreamCancelled = errors.New("stream cancelled")
+
+////////////
+// STREAM //
+////////////
+
+/*
+Stream lets an attached function respond with many items instead of one. The function builds
+the stream with NewStream and returns it. The caller gets the stream right away (through
+request.Stream() or request.Wait()) while the manager runs the producer inside the processing
+goroutine, so the producer can safely read the manager state.
+
+Sending blocks until the consumer has room for the item, so a slow consumer slows the producer
+down instead of the items piling up in memory. Because the producer runs inside the processing
+loop, the manager won't process anything else until the stream is finished. Consumers should
+always either read the stream to the end or Cancel it. If the request's context ends first
+(see SendContext and WithTimeout), send returns the context's error so the producer stops.
+*/
+type Stream struct {
+
+	// Producer is the function which fills the stream. It is run by the manager.
+	producer func(send func(item any) error) error
+
+	// Items carries the items to the consumer and is closed once the producer is done
+	items chan any
+
+	// Cancelled is closed when the consumer cancels the stream
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+
+	// Done is closed once the producer has finished and err has been set
+	done chan struct{}
+	err  error
+}
+
+// NewStream creates a stream which will be filled by the producer. Buffer is the number of
+// 	items the producer can get ahead of the consumer. The producer should call send for each
+// 	item, stop if send returns an error, and return an error if the stream failed.
+func NewStream(buffer int, producer func(send func(item any) error) error) *Stream {
+	return &Stream{
+		producer:  producer,
+		items:     make(chan any, buffer),
+		cancelled: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Items returns the channel the items arrive on. The channel is closed when the stream is
+// 	finished, after which Err reports whether it finished cleanly.
+func (stream *Stream) Items() <-chan any {
+	return stream.items
+}
+
+// Next waits for the next item in the stream. The second value is false once the stream is
+// 	finished. This allows the stream to be used as an iterator:
+//
+//	for item, ok := stream.Next(); ok; item, ok = stream.Next() { ... }
+func (stream *Stream) Next() (any, bool) {
+	item, ok := <-stream.items
+	return item, ok
+}
+
+// Err returns the error the stream finished with. It is nil while the stream is still
+// 	running, when it finished cleanly, or when the consumer cancelled it.
+func (stream *Stream) Err() error {
+	select {
+	case <-stream.done:
+		return stream.err
+	default:
+		return nil
+	}
+}
+
+// Done returns a channel which is closed once the producer has finished.
+func (stream *Stream) Done() <-chan struct{} {
+	return stream.done
+}
+
+// Cancel tells the producer to stop. Anything already buffered is discarded.
+func (stream *Stream) Cancel() {
+	stream.cancelOnce.Do(func() {
+		close(stream.cancelled)
+	})
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// run fills the stream by calling the producer. This is called from inside the processing
+// 	loop and returns whatever error the producer returned, wrapped with the route. The
+// 	request's context is cancelled once the stream is finished.
+//
+// 	If the producer panics, the stream still finishes (with an error wrapping ErrPanic) so
+// 	the consumer isn't left waiting. The manager then follows its panic policy, just as it
+// 	would for a panicking attached function.
+func (stream *Stream) run(manager *Manager, request *Request) (err error) {
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = newError("stream", manager.Name, request.Route, fmt.Errorf("%w: %v", ErrPanic, recovered))
+			stream.finish(request, err)
+			if manager.options.panics != PanicRecover {
+				panic(recovered)
+			}
+		}
+	}()
+
+	// If the request's context ends (the caller gave up or the manager's timeout passed),
+	// 	nobody is going to read the rest of the stream, so the producer has to stop too.
+	var expired <-chan struct{}
+	if request.ctx != nil {
+		expired = request.ctx.Done()
+	}
+
+	// Send blocks until the consumer takes the item, cancels, or the context ends
+	send := func(item any) error {
+		select {
+		case <-stream.cancelled:
+			return ErrStreamCancelled
+		case <-expired:
+			return request.ctx.Err()
+		default:
+		}
+		select {
+		case stream.items <- item:
+			return nil
+		case <-stream.cancelled:
+			return ErrStreamCancelled
+		case <-expired:
+			return request.ctx.Err()
+		}
+	}
+
+	err = stream.producer(send)
+	if errors.Is(err, ErrStreamCancelled) {
+		err = nil
+	}
+	if err != nil {
+		err = newError("stream", manager.Name, request.Route, err)
+	}
+	stream.finish(request, err)
+	return err
+
+}
+
+// finish records the error the stream finished with, tells the consumer it's over and
+// 	cancels the request's context.
+func (stream *Stream) finish(request *Request, err error) {
+	stream.err = err
+	close(stream.items)
+	close(stream.done)
+	if request.cancel != nil {
+		request.cancel()
+	}
+}
+
+// streamOf builds an already finished stream holding a single item. This is used when a
+// 	caller asks for a stream from a route which returned a plain value.
+func streamOf(item any) *Stream {
+	stream := &Stream{
+		items:     make(chan any, 1),
+		cancelled: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	stream.items <- item
+	close(stream.items)
+	close(stream.done)
+	return stream
+}
@@ -0,0 +1,354 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/////////////
+// CONTEXT //
+/////////////
+
+// SpanContext identifies a span within a trace. The ids are hex encoded in the same
+// 	format OpenTelemetry uses (32 characters for the trace, 16 for the span), so they can
+// 	be copied to and from other tracing libraries.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// spanContextKey is the context key the current span is stored under
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying the given span. Requests sent with the
+// 	returned context have their spans recorded as children of it.
+func ContextWithSpan(ctx context.Context, span SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, if there is one.
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	span, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return span, ok
+}
+
+//////////
+// SPAN //
+//////////
+
+// Span is a single finished, timed operation within a trace. Every request processed while
+// 	an exporter is set records two spans, both children of the span the request was sent
+// 	with: "queue <route>" for the time spent waiting in the queue, and "process <route>"
+// 	for the time spent in the attached function.
+type Span struct {
+	TraceID      string            `json:"traceId"`
+	SpanID       string            `json:"spanId"`
+	ParentSpanID string            `json:"parentSpanId,omitempty"`
+	Name         string            `json:"name"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+
+	// Error is the error the request finished with, if there was one
+	Error string `json:"error,omitempty"`
+}
+
+// Duration returns how long the span lasted.
+func (span Span) Duration() time.Duration {
+	return span.End.Sub(span.Start)
+}
+
+///////////////
+// EXPORTERS //
+///////////////
+
+// SpanExporter receives every finished span. Export is called from the processing goroutine
+// 	of the manager which recorded the span, so it should be quick and safe to call from many
+// 	managers at once.
+type SpanExporter interface {
+	Export(span Span) error
+}
+
+var (
+	spanExporter     SpanExporter
+	spanExporterLock sync.RWMutex
+)
+
+// SetSpanExporter sets where spans are sent. Tracing is off until an exporter is set, and
+// 	setting nil turns it back off.
+func SetSpanExporter(exporter SpanExporter) {
+	spanExporterLock.Lock()
+	defer spanExporterLock.Unlock()
+	spanExporter = exporter
+}
+
+// getSpanExporter returns the current exporter, or nil if tracing is off
+func getSpanExporter() SpanExporter {
+	spanExporterLock.RLock()
+	defer spanExporterLock.RUnlock()
+	return spanExporter
+}
+
+// InMemoryExporter keeps every span it is given. It is mainly useful for tests.
+type InMemoryExporter struct {
+	lock  sync.Mutex
+	spans []Span
+}
+
+// NewInMemoryExporter returns an empty in memory exporter.
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// Export stores the span.
+func (exporter *InMemoryExporter) Export(span Span) error {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	exporter.spans = append(exporter.spans, span)
+	return nil
+}
+
+// Spans returns a copy of every span exported so far, in the order they finished.
+func (exporter *InMemoryExporter) Spans() []Span {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	return append([]Span{}, exporter.spans...)
+}
+
+// Reset forgets every span exported so far.
+func (exporter *InMemoryExporter) Reset() {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	exporter.spans = nil
+}
+
+// OTLPFileExporter appends spans to a file in the OTLP JSON lines format, with one
+// 	ExportTraceServiceRequest per line. The file can be loaded by the OpenTelemetry collector's
+// 	file receiver (or most trace viewers) for offline analysis.
+type OTLPFileExporter struct {
+	lock    sync.Mutex
+	file    *os.File
+	service string
+}
+
+// NewOTLPFileExporter opens (or creates) the file at path for appending. Service is used as
+// 	the "service.name" resource attribute.
+func NewOTLPFileExporter(path string, service string) (*OTLPFileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPFileExporter{file: file, service: service}, nil
+}
+
+// Export writes the span as a single line.
+func (exporter *OTLPFileExporter) Export(span Span) error {
+
+	data, err := json.Marshal(otlpRequest(exporter.service, span))
+	if err != nil {
+		return err
+	}
+
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	_, err = exporter.file.Write(append(data, '\n'))
+	return err
+
+}
+
+// Close closes the file.
+func (exporter *OTLPFileExporter) Close() error {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	return exporter.file.Close()
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// requestSpan is the processing span of the request currently being handled
+type requestSpan struct {
+	exporter SpanExporter
+	span     Span
+}
+
+// startSpans is called by the processing loop just before a request is handled. It exports
+// 	the queue span straight away and starts the processing span. The processing span is
+// 	stored on the request, so anything the attached function sends with request.Context()
+// 	becomes a child of it. This returns nil if tracing is off.
+func (manager *Manager) startSpans(request *Request) *requestSpan {
+
+	exporter := getSpanExporter()
+	if exporter == nil {
+		return nil
+	}
+
+	// Continue the trace the request was sent with, or start a new one
+	parent := SpanContext{}
+	if request.ctx != nil {
+		parent, _ = SpanFromContext(request.ctx)
+	}
+	traceID := parent.TraceID
+	if traceID == "" {
+		traceID = newTraceID(16)
+	}
+
+	now := time.Now()
+	queued := request.queuedAt
+	if queued.IsZero() {
+		queued = now
+	}
+	attributes := func() map[string]string {
+		return map[string]string{
+			"manager.name":    manager.Name,
+			"manager.route":   request.Route,
+			"request.id":      request.ID(),
+			"request.attempt": strconv.Itoa(request.Attempt()),
+		}
+	}
+
+	exporter.Export(Span{
+		TraceID:      traceID,
+		SpanID:       newTraceID(8),
+		ParentSpanID: parent.SpanID,
+		Name:         "queue " + request.Route,
+		Start:        queued,
+		End:          now,
+		Attributes:   attributes(),
+	})
+
+	processing := &requestSpan{
+		exporter: exporter,
+		span: Span{
+			TraceID:      traceID,
+			SpanID:       newTraceID(8),
+			ParentSpanID: parent.SpanID,
+			Name:         "process " + request.Route,
+			Start:        now,
+			Attributes:   attributes(),
+		},
+	}
+	request.span = SpanContext{TraceID: traceID, SpanID: processing.span.SpanID}
+	return processing
+
+}
+
+// finish ends the processing span and exports it. It is safe to call on nil.
+func (processing *requestSpan) finish(err error) {
+	if processing == nil {
+		return
+	}
+	processing.span.End = time.Now()
+	if err != nil {
+		processing.span.Error = err.Error()
+	}
+	processing.exporter.Export(processing.span)
+}
+
+// newTraceID returns a random hex id with the given number of bytes
+func newTraceID(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// The OTLP JSON encoding of a single span. Only the parts of the format needed to describe
+// 	a span are included.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpRequest converts a span to the OTLP JSON encoding. Spans are internal (kind 1), and
+// 	spans with an error get the error status (code 2).
+func otlpRequest(service string, span Span) otlpTraces {
+
+	keys := make([]string, 0, len(span.Attributes))
+	for key := range span.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attributes := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: span.Attributes[key]}})
+	}
+
+	status := otlpStatus{}
+	if span.Error != "" {
+		status = otlpStatus{Code: 2, Message: span.Error}
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: service}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/flywinged/managers"},
+			Spans: []otlpSpan{{
+				TraceID:           span.TraceID,
+				SpanID:            span.SpanID,
+				ParentSpanID:      span.ParentSpanID,
+				Name:              span.Name,
+				Kind:              1,
+				StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+				EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+				Attributes:        attributes,
+				Status:            status,
+			}},
+		}},
+	}}}
+
+}
@@ -0,0 +1,352 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrTransactionAborted is wrapped by the error returned when a transaction is aborted
+	// 	because a prepare or commit step failed.
+	ErrTransactionAborted = errors.New("transaction aborted")
+
+	// ErrTransactionTimeout is wrapped by the error returned when the managers in a
+	// 	transaction couldn't all be prepared before the timeout.
+	ErrTransactionTimeout = errors.New("transaction timed out")
+)
+
+/////////////////
+// TRANSACTION //
+/////////////////
+
+/*
+Transaction updates the state of several managers as a single unit using two phases.
+
+In the prepare phase the coordinator visits each manager in turn. When a manager picks up the
+transaction, it runs the Prepare route and then holds its processing loop, so nothing else can
+see or touch its state until the transaction is over. Once every manager has prepared, the commit
+phase runs each Commit route and then releases all of the managers at once. Other requests only
+ever see the state from before or after the transaction, never part way through. The same goes
+for snapshots (see Manager.Read): write routes in a transaction are only versioned and published
+as the managers are released, and not at all if the transaction was aborted or rolled back.
+
+If a Prepare route fails (or the timeout passes before every manager has prepared) the managers
+which already prepared run their Abort route. This includes a manager which was still running its
+Prepare route when the timeout passed. If a Commit route fails, the managers which already
+committed run their Rollback route and the rest run their Abort route. Routes return errors just
+like any other attached function.
+
+Managers are always visited in order of their names, so two transactions over the same managers
+can't deadlock each other. A manager can only appear in a transaction once.
+*/
+type Transaction struct {
+
+	// Timeout is how long the coordinator waits for every manager to prepare.
+	Timeout time.Duration
+
+	steps []TransactionStep
+}
+
+// TransactionStep is the part of a transaction handled by a single manager. Every route is
+// 	called with Data. Abort and Rollback are optional.
+type TransactionStep struct {
+	Manager  *Manager
+	Prepare  string
+	Commit   string
+	Abort    string
+	Rollback string
+	Data     any
+}
+
+// NewTransaction returns an empty transaction with the given prepare timeout.
+func NewTransaction(timeout time.Duration) *Transaction {
+	return &Transaction{Timeout: timeout}
+}
+
+// Add adds a step to the transaction. It returns the transaction so calls can be chained.
+func (transaction *Transaction) Add(step TransactionStep) *Transaction {
+	transaction.steps = append(transaction.steps, step)
+	return transaction
+}
+
+// Execute runs the transaction and returns the results of the Commit routes, in the same
+// 	order the steps were added.
+func (transaction *Transaction) Execute() ([]any, error) {
+
+	// Visit the managers in name order, and make sure none of them appear twice (the second
+	// 	hold would wait forever behind the first).
+	order := make([]int, len(transaction.steps))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return transaction.steps[order[i]].Manager.Name < transaction.steps[order[j]].Manager.Name
+	})
+	for i := 1; i < len(order); i++ {
+		if transaction.steps[order[i]].Manager == transaction.steps[order[i-1]].Manager {
+			return nil, newError("transaction", transaction.steps[order[i]].Manager.Name, "", errors.New("manager appears in the transaction more than once"))
+		}
+	}
+
+	// Whatever happens, every manager which was held gets released.
+	participants := make([]*participant, len(transaction.steps))
+	defer func() {
+		for _, held := range participants {
+			if held != nil {
+				held.release()
+			}
+		}
+	}()
+
+	// PREPARE. Hold each manager in turn.
+	deadline := time.After(transaction.Timeout)
+	for _, index := range order {
+		held, err := hold(transaction.steps[index], deadline)
+		if err != nil {
+			transaction.abort(participants, order, nil)
+			return nil, err
+		}
+		participants[index] = held
+	}
+
+	// COMMIT. Every manager is held, so apply the changes.
+	results := make([]any, len(transaction.steps))
+	committed := map[int]bool{}
+	for _, index := range order {
+		result, err := participants[index].run(transaction.steps[index].Commit)
+		if err != nil {
+			transaction.abort(participants, order, committed)
+			return nil, newError("transaction", transaction.steps[index].Manager.Name, transaction.steps[index].Commit, wrapAborted(err))
+		}
+		results[index] = result
+		committed[index] = true
+	}
+
+	// The transaction is over, so the managers publish what it wrote as they're released
+	for _, held := range participants {
+		held.committed = true
+	}
+	return results, nil
+
+}
+
+// abort undoes whatever the held managers have done so far. Managers which committed run
+// 	their Rollback route and the others run their Abort route.
+func (transaction *Transaction) abort(participants []*participant, order []int, committed map[int]bool) {
+	for _, index := range order {
+		held := participants[index]
+		if held == nil {
+			continue
+		}
+		if committed[index] {
+			held.run(transaction.steps[index].Rollback)
+		} else {
+			held.run(transaction.steps[index].Abort)
+		}
+	}
+}
+
+/////////////////
+// PARTICIPANT //
+/////////////////
+
+// participant is the coordinator's handle on a manager held by a transaction. Commands are
+// 	sent to the manager's processing loop, which runs them and replies.
+type participant struct {
+	step     TransactionStep
+	request  *Request
+	commands chan string
+	replies  chan responseStruct
+
+	// cancelled is closed if the coordinator gives up before the manager picks up the
+	// 	transaction, and finished is closed when the manager lets go of it.
+	cancelled chan struct{}
+	finished  chan struct{}
+
+	// The number of write routes which succeeded while the manager was held, and whether
+	// 	the whole transaction committed. The writes are only versioned and published once
+	// 	it has, so nobody can read part of a transaction. Committed is set before release.
+	writes    uint64
+	committed bool
+}
+
+// hold queues the transaction on the step's manager and waits for it to prepare.
+func hold(step TransactionStep, deadline <-chan time.Time) (*participant, error) {
+
+	held := &participant{
+		step:      step,
+		commands:  make(chan string),
+		replies:   make(chan responseStruct),
+		cancelled: make(chan struct{}),
+		finished:  make(chan struct{}),
+	}
+	held.request = NewRequest("state|transaction", held)
+	step.Manager.SendRequest(held.request)
+
+	select {
+	case reply := <-held.replies:
+		if reply.Error != nil {
+			held.release()
+			return nil, newError("transaction", step.Manager.Name, step.Prepare, wrapAborted(reply.Error))
+		}
+		return held, nil
+	case <-held.request.Done():
+		_, err := held.request.Wait()
+		return nil, newError("transaction", step.Manager.Name, step.Prepare, wrapAborted(err))
+	case <-held.finished:
+		// The manager let go without replying, which only happens if the prepare panicked
+		return nil, newError("transaction", step.Manager.Name, step.Prepare, wrapAborted(ErrStopped))
+	case <-deadline:
+		close(held.cancelled)
+		return nil, newError("transaction", step.Manager.Name, step.Prepare, ErrTransactionTimeout)
+	}
+
+}
+
+// run has the held manager run a route. An empty route does nothing.
+func (held *participant) run(route string) (any, error) {
+
+	if route == "" {
+		return nil, nil
+	}
+
+	select {
+	case held.commands <- route:
+	case <-held.finished:
+		return nil, ErrStopped
+	}
+
+	select {
+	case reply := <-held.replies:
+		return reply.Data, reply.Error
+	case <-held.finished:
+		return nil, ErrStopped
+	}
+
+}
+
+// release lets the manager go back to processing requests, and waits for it to let go.
+func (held *participant) release() {
+	select {
+	case held.commands <- "":
+		<-held.finished
+	case <-held.finished:
+	}
+}
+
+// wrapAborted makes sure an error from a transaction step can be matched against
+// 	ErrTransactionAborted while keeping the original error.
+func wrapAborted(err error) error {
+	if err == nil {
+		return ErrTransactionAborted
+	}
+	return &transactionError{err: err}
+}
+
+// transactionError wraps a step error so that it matches both itself and ErrTransactionAborted.
+type transactionError struct {
+	err error
+}
+
+// Error describes the failed step.
+func (err *transactionError) Error() string {
+	return ErrTransactionAborted.Error() + ": " + err.err.Error()
+}
+
+// Unwrap returns the original error from the step.
+func (err *transactionError) Unwrap() error {
+	return err.err
+}
+
+// Is lets the error match ErrTransactionAborted.
+func (err *transactionError) Is(target error) bool {
+	return target == ErrTransactionAborted
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// holdTransaction is run by the processing loop when it picks up a transaction. It prepares,
+// 	then runs whatever the coordinator asks for until it is released.
+func (manager *Manager) holdTransaction(managerState any, held *participant) {
+
+	defer close(held.finished)
+
+	// The coordinator may have given up while this was queued
+	select {
+	case <-held.cancelled:
+		return
+	default:
+	}
+
+	// Prepare, and let go straight away if that failed. If the coordinator timed out while
+	// 	the prepare was running, nobody is listening for the reply anymore, so undo it.
+	published := manager.Read().Version
+	data, err := manager.call(managerState, held, held.step.Prepare)
+	if !held.reply(responseStruct{Data: data, Error: err}) {
+		if err == nil && held.step.Abort != "" {
+			manager.call(managerState, held, held.step.Abort)
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	// Hold the loop, running commands until the coordinator releases us. Writes from a
+	// 	transaction which didn't commit were aborted or rolled back, so they never happened.
+	for {
+		route := <-held.commands
+		if route == "" {
+			if held.committed && held.writes > 0 {
+				manager.wrote(managerState, published, held.writes)
+			}
+			return
+		}
+		data, err := manager.call(managerState, held, route)
+		held.reply(responseStruct{Data: data, Error: err})
+	}
+
+}
+
+// reply sends a response back to the coordinator. It returns false if the coordinator gave
+// 	up on the transaction instead.
+func (held *participant) reply(response responseStruct) bool {
+	select {
+	case held.replies <- response:
+		return true
+	case <-held.cancelled:
+		return false
+	}
+}
+
+// call runs a route of a held transaction directly from inside the processing loop, without
+// 	going through the queue. Errors returned by the route are wrapped and panics handled,
+// 	just like they are for requests. Successful writes are counted on the participant.
+func (manager *Manager) call(managerState any, held *participant, route string) (any, error) {
+
+	attached, params := manager.resolve(route)
+	if attached == nil {
+		return nil, newError("process", manager.Name, route, ErrRouteNotFound)
+	}
+
+	request := NewRequest(route, held.step.Data)
+	request.Params = params
+	manager.beginRequest(request)
+	result := manager.invoke(attached.function, managerState, request)
+	err, _ := result.(error)
+	if err != nil {
+		result = nil
+		err = newRequestError("process", manager.Name, request, err)
+	}
+	manager.endRequest(request, attached, err, false)
+	if err == nil && attached.options.write {
+		held.writes++
+	}
+	return result, err
+
+}
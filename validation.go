@@ -0,0 +1,577 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrValidation is matched by the ValidationError returned when a request's data doesn't
+// 	fit the route's input validator.
+var ErrValidation = errors.New("validation failed")
+
+///////////////
+// VALIDATOR //
+///////////////
+
+// Validator checks the data of a request before it reaches the route. Validate returns nil
+// 	or a *ValidationError, and Schema describes what the validator accepts so it can be
+// 	published through Info() and the debug endpoint.
+type Validator interface {
+	Validate(data any) error
+	Schema() *Schema
+}
+
+// Input annotates a route with a validator for the request data. Requests which don't pass
+// 	are refused before the route (or its middleware) runs.
+func Input(validator Validator) RouteOption {
+	return func(options *routeOptions) {
+		options.input = validator
+	}
+}
+
+// ValidationError lists everything wrong with a request's data.
+type ValidationError struct {
+	Problems []FieldProblem
+}
+
+// FieldProblem is a single thing wrong with a request's data. Field is the path to the bad
+// 	value, like "items[2].name", and is empty when the problem is with the data as a whole.
+type FieldProblem struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+// Error lists every problem.
+func (err *ValidationError) Error() string {
+	problems := make([]string, len(err.Problems))
+	for i, problem := range err.Problems {
+		field := problem.Field
+		if field == "" {
+			field = "value"
+		}
+		problems[i] = field + " " + problem.Problem
+	}
+	return ErrValidation.Error() + ": " + strings.Join(problems, "; ")
+}
+
+// Is lets the error match ErrValidation.
+func (err *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// add records a problem
+func (err *ValidationError) add(field string, problem string) {
+	err.Problems = append(err.Problems, FieldProblem{Field: field, Problem: problem})
+}
+
+// result returns the error, or nil if there weren't any problems
+func (err *ValidationError) result() error {
+	if len(err.Problems) == 0 {
+		return nil
+	}
+	return err
+}
+
+////////////
+// SCHEMA //
+////////////
+
+/*
+Schema is a subset of JSON Schema which can be used as a validator. Data is converted to JSON
+first, so a schema can check Go structs, maps, or raw JSON (json.RawMessage) alike.
+
+	managers.Input(&managers.Schema{
+		Type:     "object",
+		Required: []string{"name"},
+		Properties: map[string]*managers.Schema{
+			"name": {Type: "string", MinLength: managers.Int(1)},
+			"age":  {Type: "integer", Minimum: managers.Float(0)},
+		},
+	})
+*/
+type Schema struct {
+	Type       string             `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+	Enum       []any              `json:"enum,omitempty"`
+	Minimum    *float64           `json:"minimum,omitempty"`
+	Maximum    *float64           `json:"maximum,omitempty"`
+	MinLength  *int               `json:"minLength,omitempty"`
+	MaxLength  *int               `json:"maxLength,omitempty"`
+	MinItems   *int               `json:"minItems,omitempty"`
+	MaxItems   *int               `json:"maxItems,omitempty"`
+	Pattern    string             `json:"pattern,omitempty"`
+}
+
+// Int returns a pointer to an int, for filling in a schema.
+func Int(value int) *int {
+	return &value
+}
+
+// Float returns a pointer to a float, for filling in a schema.
+func Float(value float64) *float64 {
+	return &value
+}
+
+// Validate checks the data against the schema.
+func (schema *Schema) Validate(data any) error {
+
+	// Convert the data into plain JSON values
+	raw, ok := data.(json.RawMessage)
+	if !ok {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return &ValidationError{Problems: []FieldProblem{{Problem: "can't be encoded as JSON: " + err.Error()}}}
+		}
+		raw = encoded
+	}
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return &ValidationError{Problems: []FieldProblem{{Problem: "isn't valid JSON: " + err.Error()}}}
+	}
+
+	problems := &ValidationError{}
+	schema.check("", value, problems)
+	return problems.result()
+
+}
+
+// Schema returns the schema itself, so a schema can be used as a Validator.
+func (schema *Schema) Schema() *Schema {
+	return schema
+}
+
+// SchemaOf describes a Go type as a schema. Fields are named the same way encoding/json
+// 	names them, and `validate` struct tags (see TypeOf) fill in the constraints.
+func SchemaOf(example any) *Schema {
+	return schemaOf(reflect.TypeOf(example))
+}
+
+/////////////
+// TYPE OF //
+/////////////
+
+/*
+TypeOf returns a validator which only accepts data of the same Go type as the example (or a
+pointer to it). Structs are also checked against their `validate` struct tags, including
+nested structs:
+
+	type Order struct {
+		Item     string `json:"item" validate:"required"`
+		Quantity int    `json:"quantity" validate:"min=1,max=100"`
+		Speed    string `json:"speed" validate:"oneof=standard express"`
+	}
+	manager.Attach("order", placeOrder, managers.Input(managers.TypeOf(Order{})))
+
+The rules are "required" (the field isn't its zero value), "min" and "max" (the value of a
+number, or the length of a string, slice or map) and "oneof" (a space separated list).
+*/
+func TypeOf(example any) Validator {
+	return &typeValidator{kind: reflect.TypeOf(example)}
+}
+
+// typeValidator is the validator returned by TypeOf
+type typeValidator struct {
+	kind reflect.Type
+}
+
+// Validate checks the type of the data and then its struct tags.
+func (validator *typeValidator) Validate(data any) error {
+
+	problems := &ValidationError{}
+	value := reflect.ValueOf(data)
+	if value.Kind() == reflect.Pointer && value.Type().Elem() == validator.kind {
+		if value.IsNil() {
+			problems.add("", "is required")
+			return problems
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() || value.Type() != validator.kind {
+		problems.add("", fmt.Sprintf("must be a %v, not %T", validator.kind, data))
+		return problems
+	}
+
+	checkStruct("", value, map[visitedPointer]bool{}, problems)
+	return problems.result()
+
+}
+
+// Schema describes the type.
+func (validator *typeValidator) Schema() *Schema {
+	return schemaOf(validator.kind)
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// validate checks a request against the input validator of the route it resolved to.
+func (manager *Manager) validate(request *Request, attached *routeRecord) error {
+	if attached == nil || attached.options.input == nil {
+		return nil
+	}
+	return attached.options.input.Validate(request.Data)
+}
+
+// check validates a plain JSON value (decoded with UseNumber) against the schema.
+func (schema *Schema) check(path string, value any, problems *ValidationError) {
+
+	if schema == nil {
+		return
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			problems.add(path, "must be an object")
+			return
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				problems.add(joinField(path, name), "is required")
+			}
+		}
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := object[name]; ok {
+				schema.Properties[name].check(joinField(path, name), property, problems)
+			}
+		}
+
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			problems.add(path, "must be an array")
+			return
+		}
+		checkLength(path, len(array), schema.MinItems, schema.MaxItems, "items", problems)
+		for i, item := range array {
+			schema.Items.check(path+"["+strconv.Itoa(i)+"]", item, problems)
+		}
+
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			problems.add(path, "must be a string")
+			return
+		}
+		checkLength(path, len([]rune(text)), schema.MinLength, schema.MaxLength, "characters", problems)
+		if schema.Pattern != "" {
+			if matched, err := regexp.MatchString(schema.Pattern, text); err != nil || !matched {
+				problems.add(path, "must match "+strconv.Quote(schema.Pattern))
+			}
+		}
+
+	case "number", "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			problems.add(path, "must be a "+schema.Type)
+			return
+		}
+		float, _ := number.Float64()
+		if schema.Type == "integer" && float != math.Trunc(float) {
+			problems.add(path, "must be an integer")
+			return
+		}
+		checkRange(path, float, schema.Minimum, schema.Maximum, problems)
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems.add(path, "must be a boolean")
+			return
+		}
+
+	case "null":
+		if value != nil {
+			problems.add(path, "must be null")
+			return
+		}
+	}
+
+	// Enum values are compared by their JSON encoding, so 1 and 1.0 are the same
+	if len(schema.Enum) > 0 {
+		encoded, _ := json.Marshal(value)
+		for _, allowed := range schema.Enum {
+			if option, _ := json.Marshal(allowed); bytes.Equal(encoded, option) {
+				return
+			}
+		}
+		problems.add(path, "must be one of "+formatEnum(schema.Enum))
+	}
+
+}
+
+// visitedPointer is a pointer checkStruct is following. The type is kept along with the
+// 	address because a struct and its first field share one.
+type visitedPointer struct {
+	address uintptr
+	kind    reflect.Type
+}
+
+// checkStruct applies the validate tags of a struct, recursing into nested structs. Visiting
+// 	holds the pointers being followed on the way down, so data which points back to itself
+// 	(like a circular linked list) is only checked once instead of forever.
+func checkStruct(path string, value reflect.Value, visiting map[visitedPointer]bool, problems *ValidationError) {
+
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return
+		}
+		pointer := visitedPointer{address: value.Pointer(), kind: value.Type()}
+		if visiting[pointer] {
+			return
+		}
+		visiting[pointer] = true
+		defer delete(visiting, pointer)
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+
+		field := value.Type().Field(i)
+		name, ok := fieldName(field)
+		if !ok {
+			continue
+		}
+		fieldPath := joinField(path, name)
+		fieldValue := value.Field(i)
+
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			rule, argument, _ := strings.Cut(strings.TrimSpace(rule), "=")
+			switch rule {
+			case "required":
+				if fieldValue.IsZero() {
+					problems.add(fieldPath, "is required")
+				}
+			case "min", "max":
+				limit, err := strconv.ParseFloat(argument, 64)
+				if err != nil {
+					continue
+				}
+				var minimum, maximum *float64
+				if rule == "min" {
+					minimum = &limit
+				} else {
+					maximum = &limit
+				}
+				switch fieldValue.Kind() {
+				case reflect.String:
+					checkRange(fieldPath, float64(len([]rune(fieldValue.String()))), minimum, maximum, problems)
+				case reflect.Slice, reflect.Array, reflect.Map:
+					checkRange(fieldPath, float64(fieldValue.Len()), minimum, maximum, problems)
+				default:
+					if number, ok := numberOf(fieldValue); ok {
+						checkRange(fieldPath, number, minimum, maximum, problems)
+					}
+				}
+			case "oneof":
+				options := strings.Fields(argument)
+				found := false
+				for _, option := range options {
+					if fmt.Sprint(fieldValue.Interface()) == option {
+						found = true
+					}
+				}
+				if !found {
+					problems.add(fieldPath, "must be one of "+strings.Join(options, ", "))
+				}
+			}
+		}
+
+		checkStruct(fieldPath, fieldValue, visiting, problems)
+
+	}
+
+}
+
+// schemaOf describes a Go type as a schema.
+func schemaOf(kind reflect.Type) *Schema {
+	return schemaFor(kind, map[reflect.Type]bool{})
+}
+
+// schemaFor describes a Go type as a schema. Visiting holds the structs being described on
+// 	the way down, so a type which refers back to itself (like a linked list node) is described
+// 	as a plain object the second time instead of forever.
+func schemaFor(kind reflect.Type, visiting map[reflect.Type]bool) *Schema {
+
+	if kind == nil {
+		return &Schema{}
+	}
+	if kind == reflect.TypeOf(time.Time{}) {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch kind.Kind() {
+	case reflect.Pointer:
+		return schemaFor(kind.Elem(), visiting)
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if kind.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: schemaFor(kind.Elem(), visiting)}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		if visiting[kind] {
+			return &Schema{Type: "object"}
+		}
+	default:
+		return &Schema{}
+	}
+
+	// Structs list their fields, with the constraints from their tags
+	visiting[kind] = true
+	defer delete(visiting, kind)
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < kind.NumField(); i++ {
+		field := kind.Field(i)
+		name, ok := fieldName(field)
+		if !ok {
+			continue
+		}
+		property := schemaFor(field.Type, visiting)
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			rule, argument, _ := strings.Cut(strings.TrimSpace(rule), "=")
+			switch rule {
+			case "required":
+				schema.Required = append(schema.Required, name)
+			case "min", "max":
+				limit, err := strconv.ParseFloat(argument, 64)
+				if err != nil {
+					continue
+				}
+				property.limit(rule == "min", limit)
+			case "oneof":
+				for _, option := range strings.Fields(argument) {
+					property.Enum = append(property.Enum, option)
+				}
+			}
+		}
+		schema.Properties[name] = property
+	}
+	return schema
+
+}
+
+// limit sets a min or max on whichever part of the schema it applies to.
+func (schema *Schema) limit(minimum bool, limit float64) {
+	switch schema.Type {
+	case "string":
+		if minimum {
+			schema.MinLength = Int(int(limit))
+		} else {
+			schema.MaxLength = Int(int(limit))
+		}
+	case "array":
+		if minimum {
+			schema.MinItems = Int(int(limit))
+		} else {
+			schema.MaxItems = Int(int(limit))
+		}
+	default:
+		if minimum {
+			schema.Minimum = Float(limit)
+		} else {
+			schema.Maximum = Float(limit)
+		}
+	}
+}
+
+// fieldName returns the name encoding/json uses for a field, or false if it's skipped.
+func fieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+// numberOf returns the value of a numeric field as a float.
+func numberOf(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
+
+// checkRange records a problem if a number is outside of the limits.
+func checkRange(path string, number float64, minimum *float64, maximum *float64, problems *ValidationError) {
+	if minimum != nil && number < *minimum {
+		problems.add(path, "must be at least "+strconv.FormatFloat(*minimum, 'f', -1, 64))
+	}
+	if maximum != nil && number > *maximum {
+		problems.add(path, "must be at most "+strconv.FormatFloat(*maximum, 'f', -1, 64))
+	}
+}
+
+// checkLength records a problem if a length is outside of the limits.
+func checkLength(path string, length int, minimum *int, maximum *int, unit string, problems *ValidationError) {
+	if minimum != nil && length < *minimum {
+		problems.add(path, "must have at least "+strconv.Itoa(*minimum)+" "+unit)
+	}
+	if maximum != nil && length > *maximum {
+		problems.add(path, "must have at most "+strconv.Itoa(*maximum)+" "+unit)
+	}
+}
+
+// joinField adds a field name onto a path.
+func joinField(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// formatEnum lists the allowed values of an enum.
+func formatEnum(enum []any) string {
+	options := make([]string, len(enum))
+	for i, option := range enum {
+		encoded, _ := json.Marshal(option)
+		options[i] = string(encoded)
+	}
+	return strings.Join(options, ", ")
+}
@@ -0,0 +1,108 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrVersionConflict is wrapped by the error returned when a request expects the state to be
+// 	at a version it no longer is (see Request.IfVersion).
+var ErrVersionConflict = errors.New("state version conflict")
+
+////////////////
+// VERSIONING //
+////////////////
+
+// Version returns the version of the manager's state. It starts at zero and goes up by one
+// 	every time a write route (see Write) succeeds, whether it was sent as a request, run as
+// 	part of a transaction or finished by a Deferred continuation, and whenever the manager
+// 	is restarted with a new state. Write routes which fail are expected to leave the state
+// 	alone, so they don't change the version.
+func (manager *Manager) Version() uint64 {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	return manager.version
+}
+
+/*
+IfVersion makes the request conditional on the version of the manager's state. If the state is
+at any other version when the manager gets to the request, the request is answered with an
+ErrVersionConflict instead of being processed. This makes read-modify-write cycles safe:
+
+	snapshot := manager.Read()
+	account := snapshot.State.(Account)
+	request := managers.NewRequest("set-balance", account.Balance+10).IfVersion(snapshot.StateVersion)
+	manager.SendRequest(request)
+	if _, err := request.Wait(); errors.Is(err, managers.ErrVersionConflict) {
+		// Somebody else changed the account first, so read it again and retry
+	}
+
+The expected version is kept in the request's metadata (MetadataExpectedVersion), so it travels
+with the request wherever it's sent. It returns the request so calls can be chained.
+*/
+func (request *Request) IfVersion(version uint64) *Request {
+	return request.WithMetadata(MetadataExpectedVersion, strconv.FormatUint(version, 10))
+}
+
+// ExpectedVersion returns the version the request expects the state to be at, and false if
+// 	the request isn't conditional.
+func (request *Request) ExpectedVersion() (uint64, bool) {
+	version, err := strconv.ParseUint(request.Metadata.Get(MetadataExpectedVersion), 10, 64)
+	return version, err == nil
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// checkVersion returns an error if the request expects the state to be at a different
+// 	version than it is. An expected version which isn't a number never matches.
+func (manager *Manager) checkVersion(request *Request) error {
+
+	expected := request.Metadata.Get(MetadataExpectedVersion)
+	if expected == "" {
+		return nil
+	}
+
+	current := manager.Version()
+	version, err := strconv.ParseUint(expected, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid expected version %q", ErrVersionConflict, expected)
+	}
+	if version != current {
+		return fmt.Errorf("%w: expected version %d, state is at version %d", ErrVersionConflict, version, current)
+	}
+	return nil
+
+}
+
+// bumpVersion moves the state on by the given number of versions.
+func (manager *Manager) bumpVersion(writes uint64) {
+	manager.stateLock.Lock()
+	defer manager.stateLock.Unlock()
+	manager.version += writes
+}
+
+// wrote is called from inside the processing goroutine once write routes have succeeded
+// 	(a single one for a request, or every write in a transaction once it has committed).
+// 	The state moves on a version for each of them, and a snapshot is published. Published
+// 	is the snapshot version from before the routes ran. If a route published a snapshot
+// 	itself, that snapshot is stamped with the new version, since it was taken from the
+// 	new state.
+func (manager *Manager) wrote(managerState any, published uint64, writes uint64) {
+
+	manager.bumpVersion(writes)
+
+	manager.snapshotLock.Lock()
+	if snapshot := manager.Read(); snapshot.Version != published {
+		snapshot.StateVersion = manager.Version()
+		manager.snapshot.Store(&snapshot)
+	}
+	manager.snapshotLock.Unlock()
+
+	manager.publishState(managerState)
+
+}
@@ -0,0 +1,504 @@
+// Created by Clayton Brown. See "LICENSE" file in root for more info.
+
+package managers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrWorkflowNotFound is returned when a workflow or a run of one doesn't exist.
+	ErrWorkflowNotFound = errors.New("workflow not found")
+
+	// ErrWorkflowFailed is wrapped by the error returned when a run doesn't complete. The
+	// 	run's status says whether it was compensated or not.
+	ErrWorkflowFailed = errors.New("workflow failed")
+
+	// ErrWorkflowExists is returned when a run is started with the id of a run which already
+	// 	exists. Use Resume to carry on with a run instead.
+	ErrWorkflowExists = errors.New("workflow run already exists")
+
+	// ErrInvalidWorkflowID is returned by the file store for run ids which can't be used as
+	// 	a file name, like ones containing a path separator.
+	ErrInvalidWorkflowID = errors.New("invalid workflow run id")
+)
+
+//////////////
+// WORKFLOW //
+//////////////
+
+/*
+Workflow is a saga: a series of steps, each of which sends a request to a route on a named
+manager. Each step receives the result of the step before it (the first step receives the
+input of the run). If a step fails, the steps which already succeeded are undone in reverse
+order by sending their result to their Compensate route.
+
+Progress is saved to a WorkflowStore before and after every step, so a run which was cut short
+(say, by the process restarting) can pick up where it left off with WorkflowEngine.Resume. A step
+which was in flight when the process stopped is sent again, so routes used by workflows should be
+safe to repeat.
+*/
+type Workflow struct {
+	Name  string
+	Steps []WorkflowStep
+}
+
+// WorkflowStep is a single step of a workflow. Compensate is optional.
+type WorkflowStep struct {
+	Name       string
+	Manager    string
+	Route      string
+	Compensate string
+}
+
+// WorkflowStatus is where a run of a workflow is up to.
+type WorkflowStatus string
+
+const (
+	// WorkflowRunning is a run which is still working through its steps
+	WorkflowRunning WorkflowStatus = "running"
+
+	// WorkflowCompleted is a run where every step succeeded
+	WorkflowCompleted WorkflowStatus = "completed"
+
+	// WorkflowCompensating is a run which had a step fail and is undoing the earlier steps
+	WorkflowCompensating WorkflowStatus = "compensating"
+
+	// WorkflowCompensated is a run which had a step fail and has undone the earlier steps
+	WorkflowCompensated WorkflowStatus = "compensated"
+
+	// WorkflowFailed is a run where a compensation failed. Resuming it will try again.
+	WorkflowFailed WorkflowStatus = "failed"
+)
+
+// WorkflowRun is the saved progress of a single run of a workflow. When the run is loaded
+// 	back from a store which serializes it (like the file store), Input and Results come back
+// 	as whatever encoding/json decodes them to (float64, string, bool, []any or
+// 	map[string]any), not the types they were run with. A resumed run passes those on to
+// 	its routes.
+type WorkflowRun struct {
+	ID       string         `json:"id"`
+	Workflow string         `json:"workflow"`
+	Status   WorkflowStatus `json:"status"`
+
+	// Step is the next step to run while running, or the next step to compensate while
+	// 	compensating.
+	Step int `json:"step"`
+
+	Input   any   `json:"input"`
+	Results []any `json:"results"`
+
+	// Error is the error which made the run compensate (or fail).
+	Error string `json:"error,omitempty"`
+
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+}
+
+///////////
+// STORE //
+///////////
+
+// WorkflowStore saves the progress of workflow runs.
+type WorkflowStore interface {
+	Save(run WorkflowRun) error
+	Load(id string) (WorkflowRun, error)
+	List() ([]WorkflowRun, error)
+}
+
+// MemoryWorkflowStore keeps runs in memory. Progress isn't kept across restarts, so this is
+// 	mainly useful for tests.
+type MemoryWorkflowStore struct {
+	lock sync.Mutex
+	runs map[string]WorkflowRun
+}
+
+// NewMemoryWorkflowStore returns an empty in memory store.
+func NewMemoryWorkflowStore() *MemoryWorkflowStore {
+	return &MemoryWorkflowStore{runs: make(map[string]WorkflowRun)}
+}
+
+// Save stores a copy of the run.
+func (store *MemoryWorkflowStore) Save(run WorkflowRun) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	run.Results = append([]any{}, run.Results...)
+	store.runs[run.ID] = run
+	return nil
+}
+
+// Load returns the run with the given id.
+func (store *MemoryWorkflowStore) Load(id string) (WorkflowRun, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	run, ok := store.runs[id]
+	if !ok {
+		return WorkflowRun{}, ErrWorkflowNotFound
+	}
+	run.Results = append([]any{}, run.Results...)
+	return run, nil
+}
+
+// List returns every run, sorted by id.
+func (store *MemoryWorkflowStore) List() ([]WorkflowRun, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	runs := make([]WorkflowRun, 0, len(store.runs))
+	for _, run := range store.runs {
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs, nil
+}
+
+// FileWorkflowStore keeps each run as a JSON file in a directory. Files are written to a
+// 	temporary file and renamed into place, so a crash never leaves a half written run.
+//
+// 	Input and Results are stored as plain JSON, so a run resumed from the file store hands
+// 	its routes float64s, []any and map[string]any instead of the concrete types it started
+// 	with. Routes used by workflows kept in this store must accept those (decode them, or
+// 	validate them with a Schema rather than TypeOf). A route which type asserts its data
+// 	will panic instead, which takes the manager down under the default PanicStop policy.
+type FileWorkflowStore struct {
+	directory string
+}
+
+// NewFileWorkflowStore returns a store using the given directory, creating it if needed.
+func NewFileWorkflowStore(directory string) (*FileWorkflowStore, error) {
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileWorkflowStore{directory: directory}, nil
+}
+
+// Save writes the run to its file.
+func (store *FileWorkflowStore) Save(run WorkflowRun) error {
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	path, err := store.path(run.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+
+}
+
+// Load reads the run with the given id.
+func (store *FileWorkflowStore) Load(id string) (WorkflowRun, error) {
+
+	run := WorkflowRun{}
+	path, err := store.path(id)
+	if err != nil {
+		return run, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return run, ErrWorkflowNotFound
+	}
+	if err != nil {
+		return run, err
+	}
+	err = json.Unmarshal(data, &run)
+	return run, err
+
+}
+
+// List reads every run in the directory, sorted by id.
+func (store *FileWorkflowStore) List() ([]WorkflowRun, error) {
+
+	paths, err := filepath.Glob(filepath.Join(store.directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]WorkflowRun, 0, len(paths))
+	for _, path := range paths {
+		run, err := store.Load(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs, nil
+
+}
+
+// path returns the file a run is kept in. Ids which would reach outside the directory are
+// 	rejected.
+func (store *FileWorkflowStore) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", ErrInvalidWorkflowID
+	}
+	return filepath.Join(store.directory, id+".json"), nil
+}
+
+////////////
+// ENGINE //
+////////////
+
+// WorkflowEngine runs workflows against the managers in the public map and keeps their
+// 	progress in a store.
+type WorkflowEngine struct {
+	store     WorkflowStore
+	lock      sync.Mutex
+	workflows map[string]Workflow
+
+	// Held while a run is checked for and first saved, so two runs can't claim one id
+	runLock sync.Mutex
+}
+
+// NewWorkflowEngine returns an engine which saves its progress to the given store.
+func NewWorkflowEngine(store WorkflowStore) *WorkflowEngine {
+	return &WorkflowEngine{
+		store:     store,
+		workflows: make(map[string]Workflow),
+	}
+}
+
+// Register adds a workflow to the engine so that it can be run (and resumed).
+func (engine *WorkflowEngine) Register(workflow Workflow) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	engine.workflows[workflow.Name] = workflow
+}
+
+// Run starts a new run of a workflow and works through it until it finishes. If id is
+// 	empty, one is generated. Ids are never reused: if a run with the id is already in the
+// 	store, ErrWorkflowExists is returned and nothing is run. The returned run says how far
+// 	it got. If it didn't complete, the error wraps ErrWorkflowFailed along with the error
+// 	from the step which failed.
+func (engine *WorkflowEngine) Run(workflowName string, id string, input any) (WorkflowRun, error) {
+
+	if _, err := engine.workflow(workflowName); err != nil {
+		return WorkflowRun{}, err
+	}
+	if id == "" {
+		id = newWorkflowID()
+	}
+
+	now := time.Now()
+	run := WorkflowRun{
+		ID:       id,
+		Workflow: workflowName,
+		Status:   WorkflowRunning,
+		Input:    input,
+		Started:  now,
+		Updated:  now,
+	}
+	if err := engine.claim(run); err != nil {
+		return run, err
+	}
+	return engine.advance(run)
+
+}
+
+// Resume loads a run from the store and carries on from wherever it was up to. Runs which
+// 	already completed or were compensated are returned as they are.
+func (engine *WorkflowEngine) Resume(id string) (WorkflowRun, error) {
+	run, err := engine.store.Load(id)
+	if err != nil {
+		return run, err
+	}
+	return engine.advance(run)
+}
+
+// ResumeAll resumes every run in the store which hasn't finished. Call this on startup to
+// 	pick up the runs which were cut short. The first error is returned, but every run is
+// 	still attempted.
+func (engine *WorkflowEngine) ResumeAll() ([]WorkflowRun, error) {
+
+	runs, err := engine.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	resumed := []WorkflowRun{}
+	var firstErr error
+	for _, run := range runs {
+		if run.Status == WorkflowCompleted || run.Status == WorkflowCompensated {
+			continue
+		}
+		run, err := engine.advance(run)
+		resumed = append(resumed, run)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return resumed, firstErr
+
+}
+
+// Status returns the saved progress of a run.
+func (engine *WorkflowEngine) Status(id string) (WorkflowRun, error) {
+	return engine.store.Load(id)
+}
+
+// List returns the saved progress of every run.
+func (engine *WorkflowEngine) List() ([]WorkflowRun, error) {
+	return engine.store.List()
+}
+
+////////////////////////
+// INTERNAL FUNCTIONS //
+////////////////////////
+
+// workflow looks up a registered workflow.
+func (engine *WorkflowEngine) workflow(name string) (Workflow, error) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	workflow, ok := engine.workflows[name]
+	if !ok {
+		return workflow, ErrWorkflowNotFound
+	}
+	return workflow, nil
+}
+
+// claim saves a new run, unless a run with its id already exists.
+func (engine *WorkflowEngine) claim(run WorkflowRun) error {
+
+	engine.runLock.Lock()
+	defer engine.runLock.Unlock()
+
+	_, err := engine.store.Load(run.ID)
+	if err == nil {
+		return ErrWorkflowExists
+	}
+	if !errors.Is(err, ErrWorkflowNotFound) {
+		return err
+	}
+	return engine.store.Save(run)
+
+}
+
+// advance works through the rest of a run, saving after every step.
+func (engine *WorkflowEngine) advance(run WorkflowRun) (WorkflowRun, error) {
+
+	workflow, err := engine.workflow(run.Workflow)
+	if err != nil {
+		return run, err
+	}
+
+	// The error which stopped the run, kept so callers can match it
+	var failure error
+
+	// Forwards through the steps
+	for run.Status == WorkflowRunning && run.Step < len(workflow.Steps) {
+
+		step := workflow.Steps[run.Step]
+		data := run.Input
+		if run.Step > 0 {
+			data = run.Results[run.Step-1]
+		}
+
+		result, err := Await(step.Manager, step.Route, data)
+		if err != nil {
+
+			// Undo the steps which succeeded, starting with the one just before this
+			run.Status = WorkflowCompensating
+			run.Error = err.Error()
+			failure = err
+			run.Step--
+		} else {
+			run.Results = append(run.Results[:run.Step], result)
+			run.Step++
+			if run.Step == len(workflow.Steps) {
+				run.Status = WorkflowCompleted
+			}
+		}
+
+		if err := engine.save(&run); err != nil {
+			return run, err
+		}
+
+	}
+
+	// A failed compensation is tried again from the same step
+	if run.Status == WorkflowFailed {
+		run.Status = WorkflowCompensating
+	}
+
+	// Backwards through the steps which need undoing
+	for run.Status == WorkflowCompensating {
+
+		if run.Step < 0 {
+			run.Status = WorkflowCompensated
+		} else if step := workflow.Steps[run.Step]; step.Compensate == "" {
+			run.Step--
+		} else if _, err := Await(step.Manager, step.Compensate, run.Results[run.Step]); err != nil {
+			run.Status = WorkflowFailed
+			run.Error = err.Error()
+			failure = err
+		} else {
+			run.Step--
+		}
+
+		if err := engine.save(&run); err != nil {
+			return run, err
+		}
+
+	}
+
+	if run.Status != WorkflowCompleted {
+		return run, newWorkflowError(run, failure)
+	}
+	return run, nil
+
+}
+
+// save stamps and stores the run.
+func (engine *WorkflowEngine) save(run *WorkflowRun) error {
+	run.Updated = time.Now()
+	return engine.store.Save(*run)
+}
+
+// newWorkflowError builds the error returned for a run which didn't complete. Err is the
+// 	error which stopped it, or nil if the run stopped before this attempt.
+func newWorkflowError(run WorkflowRun, err error) error {
+	return &workflowError{run: run, err: err}
+}
+
+// workflowError describes a run which didn't complete. It matches ErrWorkflowFailed, and
+// 	unwraps to the error which stopped the run.
+type workflowError struct {
+	run WorkflowRun
+	err error
+}
+
+// Error describes the run and why it stopped.
+func (err *workflowError) Error() string {
+	return ErrWorkflowFailed.Error() + ": " + err.run.Workflow + " " + err.run.ID + " " + string(err.run.Status) + ": " + err.run.Error
+}
+
+// Unwrap returns the error which stopped the run.
+func (err *workflowError) Unwrap() error {
+	return err.err
+}
+
+// Is lets the error match ErrWorkflowFailed.
+func (err *workflowError) Is(target error) bool {
+	return target == ErrWorkflowFailed
+}
+
+// newWorkflowID generates a random id for a run.
+func newWorkflowID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}